@@ -1,26 +1,86 @@
 package analysis
 
-import "github.com/ethereum/go-ethereum/common"
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+)
 
 type ChunkerMetrics struct {
 	ChunkerName    string
 	Gas            uint64
+	BranchGas      uint64
 	ContractsStats map[common.Address]ContractStats
+
+	// TableChunksTouched is the number of chunks touched to access JUMPDEST analysis data.
+	TableChunksTouched uint64
+}
+
+// WitnessSizeBytes estimates the size of the code witness from the charged gas, counting 32 bytes
+// per code chunk and 31 bytes per stem.
+func (m ChunkerMetrics) WitnessSizeBytes() uint64 {
+	var size uint64
+	if params.WitnessBranchReadCost > 0 {
+		size += m.BranchGas / params.WitnessBranchReadCost * 31
+	}
+	return size + ChargedChunks(m.Gas, m.BranchGas)*32
+}
+
+// ChargedChunks returns the number of chunk reads charged in the gas, given the part of it
+// charged for branches.
+func ChargedChunks(gas, branchGas uint64) uint64 {
+	if params.WitnessChunkReadCost == 0 {
+		return 0
+	}
+	return (gas - branchGas) / params.WitnessChunkReadCost
 }
 
 type ContractStats struct {
+	// Gas is the code access gas charged while executing the contract.
+	Gas              uint64
 	ChunkedSizeBytes int
-	ChunksStats      []ChunkStats
+	// TableSizeBytes is the size of the JUMPDEST analysis data stored with the code, if any.
+	TableSizeBytes int
+	// ChunksStats are sorted by chunk number.
+	ChunksStats []ChunkStats
 }
 
 type ChunkStats struct {
-	ChunkNumber   int
+	ChunkNumber int
+	// AccessedBytes counts every accessed byte of the 32-byte chunk. For the 31-byte chunker it
+	// includes the leading PUSHN byte and the last code byte of the chunk, which the baseline
+	// chunker didn't count.
 	AccessedBytes int
 	ChargedGas    uint64
 }
 
 type Chunker interface {
+	Name() string
 	Init([]common.Address, map[common.Address][]byte, bool) error
 	AccessPC(common.Address, uint64) error
 	GetReport() ChunkerMetrics
 }
+
+const (
+	opJUMP     = byte(0x56)
+	opJUMPI    = byte(0x57)
+	opJUMPDEST = byte(0x5b)
+)
+
+// JumpLanding returns whether pc, executed right after lastPC in a contract, is the destination
+// of a jump: lastPC is a JUMP, or a JUMPI not followed by the next instruction. The PCs of all
+// the calls to a contract are concatenated, so pc can also be the start of a later call, which
+// is told apart since jumps can only land on a JUMPDEST. A JUMPI to the next byte can't be told
+// apart from one not taken, so it isn't a landing.
+func JumpLanding(code []byte, lastPC, pc uint64) bool {
+	if lastPC >= uint64(len(code)) || pc >= uint64(len(code)) || code[pc] != opJUMPDEST {
+		return false
+	}
+	switch code[lastPC] {
+	case opJUMP:
+		return true
+	case opJUMPI:
+		return pc != lastPC+1
+	default:
+		return false
+	}
+}
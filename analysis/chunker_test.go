@@ -0,0 +1,197 @@
+package analysis_test
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/analysis/eof"
+	"github.com/jsign/verkle-chunking-analysis/analysis/z31bytechunker"
+	"github.com/jsign/verkle-chunking-analysis/analysis/z32bytebitmapchunker"
+	"github.com/jsign/verkle-chunking-analysis/analysis/z32bytechunker"
+)
+
+func newChunkers() []analysis.Chunker {
+	layouts := []analysis.CodeKeyLayout{
+		analysis.DefaultCodeKeyLayout,
+		analysis.NewSeparateStemsLayout(),
+		analysis.NewHeaderChunksLayout(4),
+		analysis.NewCodeHashLayout(),
+	}
+	var chunkers []analysis.Chunker
+	for _, layout := range layouts {
+		chunkers = append(chunkers,
+			z31bytechunker.New(layout),
+			z32bytechunker.New(layout, false),
+			z32bytechunker.New(layout, true),
+			z32bytebitmapchunker.New(layout, z32bytebitmapchunker.PushdataBitmap),
+			z32bytebitmapchunker.New(layout, z32bytebitmapchunker.FalseJumpdestBitset))
+	}
+	return chunkers
+}
+
+// FuzzChunkers checks properties that every chunker must satisfy for arbitrary code and
+// sequences of executed PCs, interpreted as little-endian uint16s.
+func FuzzChunkers(f *testing.F) {
+	f.Add([]byte{0x60, 0x5b, 0x56, 0x5b, 0x00}, []byte{0, 0, 2, 0, 3, 0, 4, 0})
+	f.Add(append([]byte{0x7f}, make([]byte, 100)...), []byte{0, 0, 99, 0, 33, 0})
+	f.Add([]byte{0xEF, 0x00, 0x01, 0x01, 0x00, 0x04, 0x02, 0x00, 0x01, 0x00, 0x01, 0xff, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00}, []byte{0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, code []byte, pcsBytes []byte) {
+		// Chunkers treat invalid EOF containers as legacy code.
+		_, err := eof.Parse(code)
+		legacy := err != nil
+		addrs := []common.Address{{1}, {2}}
+		contractBytecodes := map[common.Address][]byte{addrs[0]: code, addrs[1]: code}
+		var pcs []uint64
+		for i := 0; i+1 < len(pcsBytes); i += 2 {
+			pc := uint64(binary.LittleEndian.Uint16(pcsBytes[i:]))
+			if pc > uint64(len(code)) {
+				pc %= uint64(len(code)) + 1
+			}
+			pcs = append(pcs, pc)
+		}
+
+		for _, ch := range newChunkers() {
+			if err := ch.Init(addrs, contractBytecodes, true); err != nil {
+				t.Fatalf("%s: init: %s", ch.Name(), err)
+			}
+			executions := map[common.Address]*eof.Execution{addrs[0]: eofExecution(code), addrs[1]: eofExecution(code)}
+			prevGas := ch.GetReport().Gas
+			for i, pc := range pcs {
+				addr := addrs[i%len(addrs)]
+				if outsideEOFCodeSection(executions[addr], pc) {
+					continue
+				}
+				if err := ch.AccessPC(addr, pc); err != nil {
+					t.Fatalf("%s: access to pc %d failed: %s", ch.Name(), pc, err)
+				}
+				gas := ch.GetReport().Gas
+				if gas < prevGas {
+					t.Fatalf("%s: gas decreased from %d to %d", ch.Name(), prevGas, gas)
+				}
+				// Repeating a PC of an EOF container can execute another code section.
+				if executions[addr] != nil {
+					prevGas = gas
+					continue
+				}
+				if err := ch.AccessPC(addr, pc); err != nil {
+					t.Fatalf("%s: repeated access failed: %s", ch.Name(), err)
+				}
+				if repeatedGas := ch.GetReport().Gas; repeatedGas != gas {
+					t.Fatalf("%s: repeated access to pc %d charged %d gas", ch.Name(), pc, repeatedGas-gas)
+				}
+				prevGas = gas
+			}
+
+			report := ch.GetReport()
+			if report.BranchGas > report.Gas {
+				t.Fatalf("%s: branch gas %d is bigger than gas %d", ch.Name(), report.BranchGas, report.Gas)
+			}
+			var contractsGas uint64
+			for addr, stats := range report.ContractsStats {
+				contractsGas += stats.Gas
+				if stats.ChunkedSizeBytes%32 != 0 {
+					t.Fatalf("%s: chunked size %d of %v isn't 32-byte aligned", ch.Name(), stats.ChunkedSizeBytes, addr)
+				}
+				if stats.ChunkedSizeBytes < len(code) && legacy {
+					t.Fatalf("%s: chunked size %d is smaller than code size %d", ch.Name(), stats.ChunkedSizeBytes, len(code))
+				}
+			}
+			if contractsGas != report.Gas {
+				t.Fatalf("%s: contracts gas %d doesn't match total gas %d", ch.Name(), contractsGas, report.Gas)
+			}
+		}
+	})
+}
+
+// FuzzChunksStatsGas checks that the gas charged per chunk adds up to the total gas.
+func FuzzChunksStatsGas(f *testing.F) {
+	f.Add([]byte{0x60, 0x5b, 0x56, 0x5b, 0x00}, []byte{0, 0, 2, 0, 3, 0, 4, 0})
+	f.Fuzz(func(t *testing.T, code []byte, pcsBytes []byte) {
+		addr := common.Address{1}
+		contractBytecodes := map[common.Address][]byte{addr: code}
+		for _, ch := range newChunkers() {
+			if err := ch.Init([]common.Address{addr}, contractBytecodes, true); err != nil {
+				t.Fatalf("%s: init: %s", ch.Name(), err)
+			}
+			execution := eofExecution(code)
+			for i := 0; i+1 < len(pcsBytes); i += 2 {
+				pc := uint64(binary.LittleEndian.Uint16(pcsBytes[i:])) % (uint64(len(code)) + 1)
+				if outsideEOFCodeSection(execution, pc) {
+					continue
+				}
+				if err := ch.AccessPC(addr, pc); err != nil {
+					t.Fatalf("%s: access to pc %d failed: %s", ch.Name(), pc, err)
+				}
+			}
+
+			report := ch.GetReport()
+			var chunksGas uint64
+			for _, chunkStats := range report.ContractsStats[addr].ChunksStats {
+				chunksGas += chunkStats.ChargedGas
+				if chunkStats.AccessedBytes > 32 {
+					t.Fatalf("%s: chunk %d has %d accessed bytes", ch.Name(), chunkStats.ChunkNumber, chunkStats.AccessedBytes)
+				}
+			}
+			if chunksGas != report.Gas {
+				t.Fatalf("%s: chunks charged gas %d doesn't match total gas %d", ch.Name(), chunksGas, report.Gas)
+			}
+		}
+	})
+}
+
+// eofExecution returns an execution of the code if it's an EOF container, or nil otherwise. It
+// follows the same PCs as the chunkers to tell which ones they reject.
+func eofExecution(code []byte) *eof.Execution {
+	container, err := eof.Parse(code)
+	if err != nil {
+		return nil
+	}
+	return eof.NewExecution(container, code)
+}
+
+// outsideEOFCodeSection returns whether pc is outside of the code section being executed, which
+// chunkers reject. Legacy code has no execution, and every pc is accepted.
+func outsideEOFCodeSection(execution *eof.Execution, pc uint64) bool {
+	if execution == nil {
+		return false
+	}
+	_, ok := execution.Offset(pc)
+	return !ok
+}
+
+func TestAccessedBytes(t *testing.T) {
+	addr := common.Address{1}
+	contractBytecodes := map[common.Address][]byte{addr: make([]byte, 64)}
+	tests := []struct {
+		chunker analysis.Chunker
+		pcs     []uint64
+		// accessedBytes are the accessed bytes of every chunk.
+		accessedBytes []int
+	}{
+		// The leading byte of a 31-byte chunk is always accessed, and pc 30 is its last code byte.
+		{chunker: z31bytechunker.New(analysis.DefaultCodeKeyLayout), pcs: []uint64{0, 30, 31}, accessedBytes: []int{3, 2}},
+		// The 1-byte table of code without PUSHDATA shifts the code a byte, so pc 30 is the last
+		// byte of the first chunk.
+		{chunker: z32bytechunker.New(analysis.DefaultCodeKeyLayout, false), pcs: []uint64{0, 30}, accessedBytes: []int{3}},
+	}
+	for _, test := range tests {
+		if err := test.chunker.Init([]common.Address{addr}, contractBytecodes, true); err != nil {
+			t.Fatal(err)
+		}
+		for _, pc := range test.pcs {
+			if err := test.chunker.AccessPC(addr, pc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var accessedBytes []int
+		for _, chunkStats := range test.chunker.GetReport().ContractsStats[addr].ChunksStats {
+			accessedBytes = append(accessedBytes, chunkStats.AccessedBytes)
+		}
+		if !slices.Equal(accessedBytes, test.accessedBytes) {
+			t.Fatalf("%s: expected accessed bytes %v, got %v", test.chunker.Name(), test.accessedBytes, accessedBytes)
+		}
+	}
+}
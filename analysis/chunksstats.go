@@ -0,0 +1,67 @@
+package analysis
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ChunksStatsRecorder records which bytes of the code chunks of every contract are accessed,
+// and the gas charged for each chunk.
+type ChunksStatsRecorder struct {
+	contracts map[common.Address]map[int]chunkStats
+}
+
+type chunkStats struct {
+	accessedBytesBitset uint32
+	chargedGas          uint64
+}
+
+func NewChunksStatsRecorder() *ChunksStatsRecorder {
+	return &ChunksStatsRecorder{contracts: map[common.Address]map[int]chunkStats{}}
+}
+
+// Record marks the bytes of the chunk set in accessedBytes as accessed, and records the gas
+// charged for it. A chunk is only charged the first time it's accessed.
+func (r *ChunksStatsRecorder) Record(addr common.Address, chunkNumber int, accessedBytes uint32, chargedGas uint64) error {
+	chunks, ok := r.contracts[addr]
+	if !ok {
+		chunks = map[int]chunkStats{}
+		r.contracts[addr] = chunks
+	}
+	stats := chunks[chunkNumber]
+	stats.accessedBytesBitset |= accessedBytes
+	if chargedGas > 0 {
+		if stats.chargedGas > 0 {
+			return fmt.Errorf("gas already charged for chunk %d, newly charged gas must be 0", chunkNumber)
+		}
+		stats.chargedGas = chargedGas
+	}
+	chunks[chunkNumber] = stats
+	return nil
+}
+
+// ChunksStats returns the stats of the accessed chunks of the contract, sorted by chunk number.
+func (r *ChunksStatsRecorder) ChunksStats(addr common.Address) []ChunkStats {
+	chunks := r.contracts[addr]
+	chunksStats := make([]ChunkStats, 0, len(chunks))
+	for chunkNumber, stats := range chunks {
+		chunksStats = append(chunksStats, ChunkStats{
+			ChunkNumber:   chunkNumber,
+			AccessedBytes: bits.OnesCount32(stats.accessedBytesBitset),
+			ChargedGas:    stats.chargedGas,
+		})
+	}
+	sort.Slice(chunksStats, func(i, j int) bool { return chunksStats[i].ChunkNumber < chunksStats[j].ChunkNumber })
+	return chunksStats
+}
+
+// BytesRange returns the bitset of the bytes of a 32-byte chunk in [start, end).
+func BytesRange(start, end int) uint32 {
+	if end-start >= 32 {
+		return ^uint32(0)
+	}
+	return ((1 << (end - start)) - 1) << start
+}
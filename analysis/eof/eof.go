@@ -0,0 +1,325 @@
+package eof
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	ChunkSize = 32
+
+	kindTypes     = byte(0x01)
+	kindCode      = byte(0x02)
+	kindContainer = byte(0x03)
+	kindData      = byte(0xff)
+	terminator    = byte(0x00)
+
+	version = byte(0x01)
+
+	opSTOP           = byte(0x00)
+	opCALLF          = byte(0xe3)
+	opRETF           = byte(0xe4)
+	opJUMPF          = byte(0xe5)
+	opRETURNCONTRACT = byte(0xee)
+	opRETURN         = byte(0xf3)
+	opREVERT         = byte(0xfd)
+	opINVALID        = byte(0xfe)
+)
+
+var ErrNotEOF = errors.New("code is not an EOF container")
+
+// SectionKind identifies the kind of a region of an EOF container.
+type SectionKind int
+
+const (
+	SectionHeader SectionKind = iota
+	SectionTypes
+	SectionCode
+	SectionContainer
+	SectionData
+)
+
+func (k SectionKind) String() string {
+	switch k {
+	case SectionHeader:
+		return "header"
+	case SectionTypes:
+		return "types"
+	case SectionCode:
+		return "code"
+	case SectionContainer:
+		return "container"
+	case SectionData:
+		return "data"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(k))
+	}
+}
+
+// Section is a contiguous region of an EOF container. Offset and Size are expressed in
+// container bytes, and FirstChunk is the chunk number where the section starts in the
+// chunked layout.
+type Section struct {
+	Kind       SectionKind
+	Offset     int
+	Size       int
+	FirstChunk int
+}
+
+func (s Section) numChunks() int {
+	return (s.Size + ChunkSize - 1) / ChunkSize
+}
+
+// Container is a parsed EOF container (EIP-3540) laid out for code chunking.
+//
+// Since EOF code sections are validated at deploy time, there is no PUSHDATA that can be
+// confused with a JUMPDEST, so chunks don't need a first-instruction-offset byte nor a
+// jumpdest table. Every section starts at a fresh 32-byte chunk so an execution only pays
+// for chunks of the sections it actually touches.
+type Container struct {
+	Sections  []Section
+	NumChunks int
+}
+
+// IsEOF returns true if the code starts with the EOF magic.
+func IsEOF(code []byte) bool {
+	return len(code) >= 2 && code[0] == 0xEF && code[1] == 0x00
+}
+
+// Parse parses the EOF container header and computes the chunked layout of its sections.
+// It returns ErrNotEOF if the code doesn't start with the EOF magic.
+func Parse(code []byte) (*Container, error) {
+	if !IsEOF(code) {
+		return nil, ErrNotEOF
+	}
+	if len(code) < 3 || code[2] != version {
+		return nil, fmt.Errorf("unsupported EOF version")
+	}
+
+	pos := 3
+	readByte := func() (byte, error) {
+		if pos >= len(code) {
+			return 0, fmt.Errorf("unexpected end of header at offset %d", pos)
+		}
+		b := code[pos]
+		pos++
+		return b, nil
+	}
+	readUint16 := func() (int, error) {
+		if pos+2 > len(code) {
+			return 0, fmt.Errorf("unexpected end of header at offset %d", pos)
+		}
+		v := binary.BigEndian.Uint16(code[pos:])
+		pos += 2
+		return int(v), nil
+	}
+	expectKind := func(kind byte) error {
+		k, err := readByte()
+		if err != nil {
+			return err
+		}
+		if k != kind {
+			return fmt.Errorf("expected section kind %#x, got %#x", kind, k)
+		}
+		return nil
+	}
+
+	if err := expectKind(kindTypes); err != nil {
+		return nil, err
+	}
+	typesSize, err := readUint16()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := expectKind(kindCode); err != nil {
+		return nil, err
+	}
+	numCodeSections, err := readUint16()
+	if err != nil {
+		return nil, err
+	}
+	if numCodeSections == 0 {
+		return nil, fmt.Errorf("no code sections")
+	}
+	if typesSize != numCodeSections*4 {
+		return nil, fmt.Errorf("types section size %d doesn't match %d code sections", typesSize, numCodeSections)
+	}
+	codeSizes := make([]int, numCodeSections)
+	for i := range codeSizes {
+		if codeSizes[i], err = readUint16(); err != nil {
+			return nil, err
+		}
+		if codeSizes[i] == 0 {
+			return nil, fmt.Errorf("code section %d is empty", i)
+		}
+	}
+
+	kind, err := readByte()
+	if err != nil {
+		return nil, err
+	}
+	var containerSizes []int
+	if kind == kindContainer {
+		numContainers, err := readUint16()
+		if err != nil {
+			return nil, err
+		}
+		containerSizes = make([]int, numContainers)
+		for i := range containerSizes {
+			if containerSizes[i], err = readUint16(); err != nil {
+				return nil, err
+			}
+		}
+		if kind, err = readByte(); err != nil {
+			return nil, err
+		}
+	}
+	if kind != kindData {
+		return nil, fmt.Errorf("expected section kind %#x, got %#x", kindData, kind)
+	}
+	dataSize, err := readUint16()
+	if err != nil {
+		return nil, err
+	}
+	if err := expectKind(terminator); err != nil {
+		return nil, err
+	}
+
+	c := &Container{}
+	c.addSection(SectionHeader, 0, pos)
+	offset := pos
+	c.addSection(SectionTypes, offset, typesSize)
+	offset += typesSize
+	for _, size := range codeSizes {
+		c.addSection(SectionCode, offset, size)
+		offset += size
+	}
+	for _, size := range containerSizes {
+		c.addSection(SectionContainer, offset, size)
+		offset += size
+	}
+	if offset > len(code) {
+		return nil, fmt.Errorf("container body is truncated: expected at least %d bytes, got %d", offset, len(code))
+	}
+	// The data section of a deployed container can't be truncated, but we tolerate it for
+	// containers that are still waiting for auxdata (i.e: initcode).
+	c.addSection(SectionData, offset, min(dataSize, len(code)-offset))
+	offset += min(dataSize, len(code)-offset)
+	if offset != len(code) {
+		return nil, fmt.Errorf("container has %d trailing bytes", len(code)-offset)
+	}
+
+	return c, nil
+}
+
+func (c *Container) addSection(kind SectionKind, offset, size int) {
+	s := Section{Kind: kind, Offset: offset, Size: size, FirstChunk: c.NumChunks}
+	c.Sections = append(c.Sections, s)
+	c.NumChunks += s.numChunks()
+}
+
+// SectionAt returns the section containing the container offset pc.
+func (c *Container) SectionAt(pc uint64) (Section, bool) {
+	for _, s := range c.Sections {
+		if pc >= uint64(s.Offset) && pc < uint64(s.Offset+s.Size) {
+			return s, true
+		}
+	}
+	return Section{}, false
+}
+
+// CodeSection returns the code section with index i.
+func (c *Container) CodeSection(i int) (Section, bool) {
+	for _, s := range c.Sections {
+		if s.Kind != SectionCode {
+			continue
+		}
+		if i == 0 {
+			return s, true
+		}
+		i--
+	}
+	return Section{}, false
+}
+
+// ChunkNumber maps a container offset to its chunk number in the chunked layout, and the
+// offset of the byte inside that chunk. Traced PCs are relative to their code section, so
+// they're mapped to container offsets with an Execution first.
+func (c *Container) ChunkNumber(offset uint64) (uint64, int, bool) {
+	s, ok := c.SectionAt(offset)
+	if !ok {
+		return 0, 0, false
+	}
+	sectionOffset := int(offset) - s.Offset
+	return uint64(s.FirstChunk + sectionOffset/ChunkSize), sectionOffset % ChunkSize, true
+}
+
+// ChunkedSize returns the size in bytes of the chunked container.
+func (c *Container) ChunkedSize() int {
+	return c.NumChunks * ChunkSize
+}
+
+// Execution maps the PCs traced while executing a container to container offsets. Under
+// EIP-4750 a PC is relative to the code section being executed, so the section is followed
+// through the CALLF, JUMPF and RETF instructions of the traced PCs. The PCs of all the calls to
+// a contract are concatenated in a trace, so after a halting instruction the next PC starts a
+// new call in the first code section. Reentrant calls interleave with the PCs of the outer call,
+// and are attributed to the section the outer call is executing.
+type Execution struct {
+	container *Container
+	code      []byte
+	section   int
+	returns   []int
+	// lastOffset is the container offset of the previous PC, or -1 before the first one.
+	lastOffset int
+}
+
+// NewExecution returns an Execution of the container parsed from code.
+func NewExecution(container *Container, code []byte) *Execution {
+	return &Execution{container: container, code: code, lastOffset: -1}
+}
+
+// Offset returns the container offset of the traced pc. It returns false, leaving the
+// execution as it was, if pc is outside of the code section being executed.
+func (e *Execution) Offset(pc uint64) (uint64, bool) {
+	section, returns := e.section, e.returns
+	if e.lastOffset >= 0 {
+		switch op := e.code[e.lastOffset]; op {
+		case opCALLF, opJUMPF:
+			if e.lastOffset+3 > len(e.code) {
+				return 0, false
+			}
+			if op == opCALLF {
+				returns = append(slices.Clip(returns), section)
+			}
+			section = int(binary.BigEndian.Uint16(e.code[e.lastOffset+1:]))
+		case opRETF:
+			if len(returns) == 0 {
+				section = 0
+				break
+			}
+			section, returns = returns[len(returns)-1], returns[:len(returns)-1]
+		case opSTOP, opRETURNCONTRACT, opRETURN, opREVERT, opINVALID:
+			section, returns = 0, nil
+		}
+	}
+	s, ok := e.container.CodeSection(section)
+	if !ok || pc >= uint64(s.Size) {
+		return 0, false
+	}
+	e.section, e.returns, e.lastOffset = section, returns, s.Offset+int(pc)
+	return uint64(e.lastOffset), true
+}
+
+// ChunkNumber maps the traced pc to its chunk number and the offset of the byte inside that
+// chunk, as Container.ChunkNumber does for container offsets.
+func (e *Execution) ChunkNumber(pc uint64) (uint64, int, bool) {
+	offset, ok := e.Offset(pc)
+	if !ok {
+		return 0, 0, false
+	}
+	return e.container.ChunkNumber(offset)
+}
@@ -0,0 +1,219 @@
+package eof
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// container is a minimal EOF container with a 3-byte code section and a 2-byte data section.
+var container = []byte{
+	0xEF, 0x00, 0x01, // magic and version
+	0x01, 0x00, 0x04, // types section
+	0x02, 0x00, 0x01, 0x00, 0x03, // code sections
+	0xff, 0x00, 0x02, // data section
+	0x00,                   // terminator
+	0x00, 0x80, 0x00, 0x00, // types
+	0x5f, 0x5f, 0x00, // code
+	0xaa, 0xbb, // data
+}
+
+// sectionsContainer has a 40-byte code section that CALLFs the 1-byte second one at pc 0 and
+// JUMPFs to it at pc 36, a subcontainer and a data section.
+var sectionsContainer = slices.Concat(
+	[]byte{
+		0xEF, 0x00, 0x01, // magic and version
+		0x01, 0x00, 0x08, // types section
+		0x02, 0x00, 0x02, 0x00, 0x28, 0x00, 0x01, // code sections
+		0x03, 0x00, 0x01, 0x00, 0x03, // container sections
+		0xff, 0x00, 0x02, // data section
+		0x00, // terminator
+	},
+	make([]byte, 8),
+	[]byte{0xe3, 0x00, 0x01}, make([]byte, 33), []byte{0xe5, 0x00, 0x01, 0x00},
+	[]byte{0xe4},
+	[]byte{0xEF, 0x00, 0x01},
+	[]byte{0xaa, 0xbb},
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      []byte
+		sections  []Section
+		numChunks int
+	}{
+		{
+			name: "minimal",
+			code: container,
+			sections: []Section{
+				{Kind: SectionHeader, Offset: 0, Size: 15, FirstChunk: 0},
+				{Kind: SectionTypes, Offset: 15, Size: 4, FirstChunk: 1},
+				{Kind: SectionCode, Offset: 19, Size: 3, FirstChunk: 2},
+				{Kind: SectionData, Offset: 22, Size: 2, FirstChunk: 3},
+			},
+			numChunks: 4,
+		},
+		{
+			name: "sections",
+			code: sectionsContainer,
+			sections: []Section{
+				{Kind: SectionHeader, Offset: 0, Size: 22, FirstChunk: 0},
+				{Kind: SectionTypes, Offset: 22, Size: 8, FirstChunk: 1},
+				{Kind: SectionCode, Offset: 30, Size: 40, FirstChunk: 2},
+				{Kind: SectionCode, Offset: 70, Size: 1, FirstChunk: 4},
+				{Kind: SectionContainer, Offset: 71, Size: 3, FirstChunk: 5},
+				{Kind: SectionData, Offset: 74, Size: 2, FirstChunk: 6},
+			},
+			numChunks: 7,
+		},
+		{
+			name: "truncated data",
+			code: container[:len(container)-1],
+			sections: []Section{
+				{Kind: SectionHeader, Offset: 0, Size: 15, FirstChunk: 0},
+				{Kind: SectionTypes, Offset: 15, Size: 4, FirstChunk: 1},
+				{Kind: SectionCode, Offset: 19, Size: 3, FirstChunk: 2},
+				{Kind: SectionData, Offset: 22, Size: 1, FirstChunk: 3},
+			},
+			numChunks: 4,
+		},
+	}
+	for _, test := range tests {
+		c, err := Parse(test.code)
+		if err != nil {
+			t.Fatalf("%s: parsing container: %s", test.name, err)
+		}
+		if !slices.Equal(c.Sections, test.sections) {
+			t.Fatalf("%s: expected sections %+v, got %+v", test.name, test.sections, c.Sections)
+		}
+		if c.NumChunks != test.numChunks || c.ChunkedSize() != test.numChunks*ChunkSize {
+			t.Fatalf("%s: expected %d chunks, got %d and chunked size %d", test.name, test.numChunks, c.NumChunks, c.ChunkedSize())
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	withByte := func(i int, b byte) []byte {
+		code := slices.Clone(container)
+		code[i] = b
+		return code
+	}
+	tests := []struct {
+		name string
+		code []byte
+		err  string
+	}{
+		{name: "version", code: withByte(2, 0x02), err: "unsupported EOF version"},
+		{name: "truncated header", code: container[:9], err: "unexpected end of header"},
+		{name: "types kind", code: withByte(3, 0x02), err: "expected section kind 0x1"},
+		{name: "types size", code: withByte(5, 0x08), err: "doesn't match 1 code sections"},
+		{name: "no code sections", code: withByte(8, 0x00), err: "no code sections"},
+		{name: "empty code section", code: withByte(10, 0x00), err: "code section 0 is empty"},
+		{name: "data kind", code: withByte(11, 0x04), err: "expected section kind 0xff"},
+		{name: "terminator", code: withByte(14, 0x01), err: "expected section kind 0x0"},
+		{name: "truncated body", code: container[:20], err: "container body is truncated"},
+		{name: "trailing bytes", code: append(slices.Clone(container), 0x00), err: "1 trailing bytes"},
+	}
+	for _, test := range tests {
+		if _, err := Parse(test.code); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestParseNotEOF(t *testing.T) {
+	if _, err := Parse([]byte{0x60, 0x00}); err != ErrNotEOF {
+		t.Fatalf("expected ErrNotEOF, got %v", err)
+	}
+}
+
+func TestChunkNumber(t *testing.T) {
+	c, err := Parse(sectionsContainer)
+	if err != nil {
+		t.Fatalf("parsing container: %s", err)
+	}
+	tests := []struct {
+		offset      uint64
+		chunkNumber uint64
+		chunkOffset int
+	}{
+		{offset: 0, chunkNumber: 0, chunkOffset: 0},
+		{offset: 21, chunkNumber: 0, chunkOffset: 21},
+		{offset: 22, chunkNumber: 1, chunkOffset: 0},
+		{offset: 29, chunkNumber: 1, chunkOffset: 7},
+		{offset: 30, chunkNumber: 2, chunkOffset: 0},
+		{offset: 61, chunkNumber: 2, chunkOffset: 31},
+		{offset: 62, chunkNumber: 3, chunkOffset: 0},
+		{offset: 69, chunkNumber: 3, chunkOffset: 7},
+		{offset: 70, chunkNumber: 4, chunkOffset: 0},
+		{offset: 71, chunkNumber: 5, chunkOffset: 0},
+		{offset: 75, chunkNumber: 6, chunkOffset: 1},
+	}
+	for _, test := range tests {
+		chunkNumber, chunkOffset, ok := c.ChunkNumber(test.offset)
+		if !ok || chunkNumber != test.chunkNumber || chunkOffset != test.chunkOffset {
+			t.Fatalf("expected offset %d in chunk %d offset %d, got chunk %d offset %d (%v)",
+				test.offset, test.chunkNumber, test.chunkOffset, chunkNumber, chunkOffset, ok)
+		}
+	}
+	if _, _, ok := c.ChunkNumber(uint64(len(sectionsContainer))); ok {
+		t.Fatalf("expected offset out of the container to not be mapped")
+	}
+}
+
+func TestExecution(t *testing.T) {
+	c, err := Parse(sectionsContainer)
+	if err != nil {
+		t.Fatalf("parsing container: %s", err)
+	}
+	e := NewExecution(c, sectionsContainer)
+	tests := []struct {
+		pc     uint64
+		offset uint64
+		ok     bool
+	}{
+		// CALLF 1, and a PC past the end of section 1 that doesn't change the execution.
+		{pc: 0, offset: 30, ok: true},
+		{pc: 5, ok: false},
+		{pc: 0, offset: 70, ok: true},
+		// RETF back to section 0, which stops at pc 3.
+		{pc: 3, offset: 33, ok: true},
+		// A later call starts in section 0, and JUMPFs to section 1 at pc 36.
+		{pc: 36, offset: 66, ok: true},
+		{pc: 0, offset: 70, ok: true},
+		// RETF without a CALLF ends the call, so the next one starts in section 0.
+		{pc: 39, offset: 69, ok: true},
+	}
+	for i, test := range tests {
+		offset, ok := e.Offset(test.pc)
+		if ok != test.ok || offset != test.offset {
+			t.Fatalf("PC %d (#%d): expected offset %d (%v), got %d (%v)", test.pc, i, test.offset, test.ok, offset, ok)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(container)
+	f.Add(sectionsContainer)
+	f.Add([]byte{0xEF, 0x00})
+	f.Fuzz(func(t *testing.T, code []byte) {
+		c, err := Parse(code)
+		if err != nil {
+			return
+		}
+		var size int
+		for _, s := range c.Sections {
+			size += s.Size
+		}
+		if size != len(code) {
+			t.Fatalf("sections cover %d bytes, container has %d", size, len(code))
+		}
+		for pc := range code {
+			chunkNumber, chunkOffset, ok := c.ChunkNumber(uint64(pc))
+			if !ok || chunkNumber >= uint64(c.NumChunks) || chunkOffset >= ChunkSize {
+				t.Fatalf("pc %d mapped to chunk %d offset %d (%v)", pc, chunkNumber, chunkOffset, ok)
+			}
+		}
+	})
+}
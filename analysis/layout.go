@@ -0,0 +1,174 @@
+package analysis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
+)
+
+const (
+	verkleNodeWidth = 256
+	// maxHeaderChunks is the number of code chunks that fit in the account header stem, since
+	// its first 128 sub-indexes hold the account fields and the first storage slots.
+	maxHeaderChunks = 128
+)
+
+// CodeKeyLayout defines where code chunks are placed in the verkle tree.
+type CodeKeyLayout interface {
+	// Name returns the name of the layout, which can be parsed back with ParseCodeKeyLayout.
+	Name() string
+	// TreeKeyAddress returns the address used to derive the stems of the contract code chunks.
+	TreeKeyAddress(addr common.Address, code []byte) []byte
+	// ChunkIndexes returns the tree index and sub-index of a code chunk.
+	ChunkIndexes(chunkNumber uint64) (uint256.Int, byte)
+}
+
+// DefaultCodeKeyLayout is the EIP-6800 layout, where the first 128 code chunks share the
+// account header stem.
+var DefaultCodeKeyLayout CodeKeyLayout = NewHeaderChunksLayout(128)
+
+type headerChunksLayout struct {
+	headerChunks uint64
+}
+
+// NewHeaderChunksLayout returns a layout where the first headerChunks code chunks are placed
+// in the account header stem, and the rest in the following stems of the account.
+func NewHeaderChunksLayout(headerChunks uint64) CodeKeyLayout {
+	return headerChunksLayout{headerChunks: headerChunks}
+}
+
+// NewSeparateStemsLayout returns a layout where all code chunks are placed in stems separate
+// from the account header.
+func NewSeparateStemsLayout() CodeKeyLayout {
+	return headerChunksLayout{headerChunks: 0}
+}
+
+func (l headerChunksLayout) Name() string {
+	switch l.headerChunks {
+	case 128:
+		return "eip6800"
+	case 0:
+		return "separatestems"
+	default:
+		return fmt.Sprintf("header%d", l.headerChunks)
+	}
+}
+
+func (l headerChunksLayout) TreeKeyAddress(addr common.Address, _ []byte) []byte {
+	return addr.Bytes()
+}
+
+func (l headerChunksLayout) ChunkIndexes(chunkNumber uint64) (uint256.Int, byte) {
+	offset := chunkNumber + verkleNodeWidth - l.headerChunks
+	return *uint256.NewInt(offset / verkleNodeWidth), byte(offset % verkleNodeWidth)
+}
+
+type codeHashLayout struct{}
+
+// NewCodeHashLayout returns a layout where code chunks are placed in stems derived from the
+// code hash instead of the account address, so identical code is shared between accounts.
+func NewCodeHashLayout() CodeKeyLayout {
+	return codeHashLayout{}
+}
+
+func (codeHashLayout) Name() string {
+	return "codehash"
+}
+
+func (codeHashLayout) TreeKeyAddress(_ common.Address, code []byte) []byte {
+	return crypto.Keccak256(code)[:common.AddressLength]
+}
+
+func (codeHashLayout) ChunkIndexes(chunkNumber uint64) (uint256.Int, byte) {
+	return *uint256.NewInt(chunkNumber / verkleNodeWidth), byte(chunkNumber % verkleNodeWidth)
+}
+
+// ParseCodeKeyLayout parses a layout name: eip6800, separatestems, codehash or header<N>.
+func ParseCodeKeyLayout(name string) (CodeKeyLayout, error) {
+	switch name {
+	case "eip6800":
+		return DefaultCodeKeyLayout, nil
+	case "separatestems":
+		return NewSeparateStemsLayout(), nil
+	case "codehash":
+		return NewCodeHashLayout(), nil
+	}
+	if n, ok := strings.CutPrefix(name, "header"); ok {
+		headerChunks, err := strconv.ParseUint(n, 10, 64)
+		if err != nil || headerChunks > maxHeaderChunks {
+			return nil, fmt.Errorf("invalid header chunks count in layout %s", name)
+		}
+		return NewHeaderChunksLayout(headerChunks), nil
+	}
+	return nil, fmt.Errorf("unknown code key layout %s", name)
+}
+
+// ChunkerName returns the name of a chunker running under a layout. Chunkers running under
+// the default layout keep their base name.
+func ChunkerName(baseName string, layout CodeKeyLayout) string {
+	if layout.Name() == DefaultCodeKeyLayout.Name() {
+		return baseName
+	}
+	return baseName + "_" + layout.Name()
+}
+
+// NumStems returns the number of stems holding the first numChunks code chunks of a contract.
+func NumStems(layout CodeKeyLayout, numChunks uint64) int {
+	stems := map[uint256.Int]struct{}{}
+	for chunkNumber := uint64(0); chunkNumber < numChunks; chunkNumber++ {
+		treeIndex, _ := layout.ChunkIndexes(chunkNumber)
+		stems[treeIndex] = struct{}{}
+	}
+	return len(stems)
+}
+
+// TouchCodeChunk touches a code chunk in the access witness, and returns the charged gas and
+// the part of it charged for accessing a new branch.
+func TouchCodeChunk(aw *state.AccessWitness, layout CodeKeyLayout, treeKeyAddr []byte, chunkNumber uint64) (uint64, uint64) {
+	treeIndex, subIndex := layout.ChunkIndexes(chunkNumber)
+	gas := aw.TouchAddressAndChargeGas(treeKeyAddr, treeIndex, subIndex, false)
+	if gas >= params.WitnessBranchReadCost {
+		return gas, params.WitnessBranchReadCost
+	}
+	return gas, 0
+}
+
+// TouchCodeChunksRange is a generalization of AccessWitness.TouchCodeChunksRangeAndChargeGas for
+// any chunk size and code key layout. shift is the number of bytes placed before the code in the
+// chunked code (e.g: a JUMPDEST table). It returns the charged gas and the part of it charged
+// for accessing new branches.
+func TouchCodeChunksRange(aw *state.AccessWitness, layout CodeKeyLayout, treeKeyAddr []byte, startPC, size, codeLen, chunkSize, shift uint64) (uint64, uint64) {
+	if (codeLen == 0 && size == 0) || startPC > codeLen {
+		return 0, 0
+	}
+
+	endPC := startPC + size
+	if endPC > codeLen {
+		endPC = codeLen
+	}
+	if endPC > 0 {
+		endPC -= 1 // endPC is the last bytecode that will be touched.
+	}
+	startPC += shift
+	endPC += shift
+
+	var gas, branchGas uint64
+	for chunkNumber := startPC / chunkSize; chunkNumber <= endPC/chunkSize; chunkNumber++ {
+		chunkGas, chunkBranchGas := TouchCodeChunk(aw, layout, treeKeyAddr, chunkNumber)
+		var overflow bool
+		gas, overflow = math.SafeAdd(gas, chunkGas)
+		if overflow {
+			panic("overflow when adding gas")
+		}
+		branchGas += chunkBranchGas
+	}
+
+	return gas, branchGas
+}
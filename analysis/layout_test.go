@@ -0,0 +1,30 @@
+package analysis
+
+import "testing"
+
+func TestParseHeaderChunksLayout(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "header128", expected: "eip6800"},
+		{name: "header129"},
+		{name: "header256"},
+	}
+	for _, test := range tests {
+		layout, err := ParseCodeKeyLayout(test.name)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("expected %s to be rejected, since code chunks would overlap the account header fields", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsing %s: %s", test.name, err)
+			continue
+		}
+		if layout.Name() != test.expected {
+			t.Errorf("expected %s to parse as %s, got %s", test.name, test.expected, layout.Name())
+		}
+	}
+}
@@ -7,33 +7,42 @@ import (
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/trie"
 	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/analysis/eof"
 )
 
 type Chunker struct {
+	layout analysis.CodeKeyLayout
+
 	contractBytecodes map[common.Address][]byte
 	accessEvents      *state.AccessWitness
 	enableChunksStats bool
+	eofExecutions     map[common.Address]*eof.Execution
+	treeKeyAddrs      map[common.Address][]byte
 
 	gas            uint64
+	branchGas      uint64
 	contractsStats map[common.Address]contractStats
+	chunksStats    *analysis.ChunksStatsRecorder
 }
 
 type contractStats struct {
+	gas              uint64
 	chunkedSizeBytes int
-	chunksStats      map[int]chunkStats
 }
-type chunkStats struct {
-	accessedBytesBitset uint32
-	chargedGas          uint64
+
+func New(layout analysis.CodeKeyLayout) *Chunker {
+	return &Chunker{layout: layout}
 }
 
-func New() *Chunker {
-	return &Chunker{}
+func (c *Chunker) Name() string {
+	return analysis.ChunkerName("31bytechunker", c.layout)
 }
 
 func (c *Chunker) Init(touchedContracts []common.Address, contractBytecodes map[common.Address][]byte, enableChunksStats bool) error {
 	accessEvents := state.NewAccessWitness(nil)
 	contractsStats := map[common.Address]contractStats{}
+	eofExecutions := map[common.Address]*eof.Execution{}
+	treeKeyAddrs := map[common.Address][]byte{}
 	for _, addr := range touchedContracts {
 		// The touched contracts are the tx destination, or contracts that are called by the tx.
 		// In any case, we warm those accounts headers since tx destination or *CALL targets will
@@ -44,72 +53,86 @@ func (c *Chunker) Init(touchedContracts []common.Address, contractBytecodes map[
 		if !ok {
 			return fmt.Errorf("contract %v not found in contractBytecodes", addr)
 		}
+		treeKeyAddrs[addr] = c.layout.TreeKeyAddress(addr, contractCode)
 
 		cs := contractsStats[addr]
-		cs.chunkedSizeBytes = len(trie.ChunkifyCode(contractCode))
-		cs.chunksStats = map[int]chunkStats{}
+		// EOF containers don't need the first-instruction-offset byte, so they're chunked
+		// in 32-byte chunks per section. Invalid containers are treated as legacy code.
+		if container, err := eof.Parse(contractCode); err == nil {
+			eofExecutions[addr] = eof.NewExecution(container, contractCode)
+			cs.chunkedSizeBytes = container.ChunkedSize()
+		} else {
+			cs.chunkedSizeBytes = len(trie.ChunkifyCode(contractCode))
+		}
 		contractsStats[addr] = cs
 	}
 	*c = Chunker{
+		layout:            c.layout,
 		contractBytecodes: contractBytecodes,
 		accessEvents:      accessEvents,
 		contractsStats:    contractsStats,
+		chunksStats:       analysis.NewChunksStatsRecorder(),
 		enableChunksStats: enableChunksStats,
+		eofExecutions:     eofExecutions,
+		treeKeyAddrs:      treeKeyAddrs,
 	}
 
 	return nil
 }
 
 func (c *Chunker) AccessPC(addr common.Address, pc uint64) error {
-	chargedGas := c.accessEvents.TouchCodeChunksRangeAndChargeGas(addr.Bytes(), pc, 1, uint64(len(c.contractBytecodes[addr])), false)
-	c.gas += chargedGas
+	if execution, ok := c.eofExecutions[addr]; ok {
+		return c.accessEOFPC(addr, execution, pc)
+	}
+
+	chargedGas, branchGas := analysis.TouchCodeChunksRange(c.accessEvents, c.layout, c.treeKeyAddrs[addr], pc, 1, uint64(len(c.contractBytecodes[addr])), 31, 0)
+	c.chargeGas(addr, chargedGas, branchGas)
 
 	if !c.enableChunksStats {
 		return nil
 	}
 
-	chunkNumber := int(pc / 31)
-	chunkStats := c.contractsStats[addr].chunksStats[chunkNumber]
-	chunkStats.accessedBytesBitset |= 1                // Consider the first byte of the chunk (PUSHN byte) always accessed.
-	chunkStats.accessedBytesBitset |= 1 << (pc%31 + 1) // Mark the accessed byte in the bitset.
+	// Consider the first byte of the chunk (PUSHN byte) always accessed, besides the accessed byte.
+	accessedBytes := uint32(1) | 1<<(pc%31+1)
+	return c.chunksStats.Record(addr, int(pc/31), accessedBytes, chargedGas)
+}
 
-	if chargedGas > 0 {
-		if chunkStats.chargedGas > 0 {
-			return fmt.Errorf("gas already charged for chunk %d, newly charged gas must be 0", chunkNumber)
-		}
-		chunkStats.chargedGas = chargedGas
+func (c *Chunker) accessEOFPC(addr common.Address, execution *eof.Execution, pc uint64) error {
+	chunkNumber, chunkOffset, ok := execution.ChunkNumber(pc)
+	if !ok {
+		return fmt.Errorf("pc %d is outside of the executed EOF code section of %v", pc, addr)
 	}
-	c.contractsStats[addr].chunksStats[chunkNumber] = chunkStats
+	chargedGas, branchGas := analysis.TouchCodeChunk(c.accessEvents, c.layout, c.treeKeyAddrs[addr], chunkNumber)
+	c.chargeGas(addr, chargedGas, branchGas)
 
-	return nil
+	if !c.enableChunksStats {
+		return nil
+	}
+
+	return c.chunksStats.Record(addr, int(chunkNumber), 1<<chunkOffset, chargedGas)
+}
+
+func (c *Chunker) chargeGas(addr common.Address, gas, branchGas uint64) {
+	c.gas += gas
+	c.branchGas += branchGas
+	cs := c.contractsStats[addr]
+	cs.gas += gas
+	c.contractsStats[addr] = cs
 }
 
 func (c *Chunker) GetReport() analysis.ChunkerMetrics {
 	contractsStats := make(map[common.Address]analysis.ContractStats, len(c.contractsStats))
 	for addr, stats := range c.contractsStats {
-		chunksStats := make([]analysis.ChunkStats, 0, len(stats.chunksStats))
-		for chunkNumber, chstats := range stats.chunksStats {
-			var accessedBytes int
-			for i := 0; i < 31; i++ {
-				if chstats.accessedBytesBitset&(1<<i) != 0 {
-					accessedBytes++
-				}
-			}
-			chunksStats = append(chunksStats, analysis.ChunkStats{
-				ChunkNumber:   chunkNumber,
-				AccessedBytes: accessedBytes,
-				ChargedGas:    chstats.chargedGas,
-			})
-		}
-
 		contractsStats[addr] = analysis.ContractStats{
+			Gas:              stats.gas,
 			ChunkedSizeBytes: stats.chunkedSizeBytes,
-			ChunksStats:      chunksStats,
+			ChunksStats:      c.chunksStats.ChunksStats(addr),
 		}
 	}
 	return analysis.ChunkerMetrics{
-		ChunkerName:    "31bytechunker",
+		ChunkerName:    c.Name(),
 		Gas:            c.gas,
+		BranchGas:      c.branchGas,
 		ContractsStats: contractsStats,
 	}
 }
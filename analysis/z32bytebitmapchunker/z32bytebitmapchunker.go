@@ -0,0 +1,228 @@
+package z32bytebitmapchunker
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/analysis/eof"
+)
+
+// Encoding is the encoding of the JUMPDEST analysis data stored in dedicated leaves placed
+// after the code chunks.
+type Encoding int
+
+const (
+	// PushdataBitmap stores a 32-bit bitmap per code chunk marking which bytes are PUSHDATA,
+	// so a leaf covers 8 code chunks.
+	PushdataBitmap Encoding = iota
+	// FalseJumpdestBitset stores a bit per code chunk marking if it has a JUMPDEST byte in
+	// PUSHDATA, so a leaf covers 256 code chunks.
+	FalseJumpdestBitset
+)
+
+const (
+	PUSH1    = byte(0x60)
+	PUSH32   = byte(0x7f)
+	JUMPDEST = byte(0x5b)
+)
+
+// Chunker does a 32-byte slicing of the code, and stores the JUMPDEST analysis data in
+// dedicated leaves. When a jump lands on a JUMPDEST, the leaf containing the entry of its code
+// chunk is also accessed, under the same rule as the lazy table of the 32-byte chunker.
+type Chunker struct {
+	layout   analysis.CodeKeyLayout
+	encoding Encoding
+
+	contractBytecodes map[common.Address][]byte
+	aw                *state.AccessWitness
+	enableChunksStats bool
+	chunksStats       *analysis.ChunksStatsRecorder
+
+	gas                uint64
+	branchGas          uint64
+	tableChunksTouched uint64
+	contracts          map[common.Address]contractInfo
+	contractsGas       map[common.Address]uint64
+	lastPCs            map[common.Address]uint64
+}
+
+type contractInfo struct {
+	treeKeyAddr   []byte
+	eofExecution  *eof.Execution
+	numCodeChunks uint64
+	// numTableEntries is the number of code chunks with an entry in the table. Trailing
+	// chunks without PUSHDATA (or false JUMPDESTs) don't need an entry.
+	numTableEntries uint64
+	tableSize       int
+	chunkedSize     int
+}
+
+func New(layout analysis.CodeKeyLayout, encoding Encoding) *Chunker {
+	return &Chunker{layout: layout, encoding: encoding}
+}
+
+func (c *Chunker) Name() string {
+	switch c.encoding {
+	case PushdataBitmap:
+		return analysis.ChunkerName("32bytebitmapchunker", c.layout)
+	case FalseJumpdestBitset:
+		return analysis.ChunkerName("32bytebitsetchunker", c.layout)
+	default:
+		panic(fmt.Sprintf("unknown encoding %d", c.encoding))
+	}
+}
+
+func (c *Chunker) Init(touchedContracts []common.Address, contractBytecodes map[common.Address][]byte, enableChunksStats bool) error {
+	*c = Chunker{
+		layout:            c.layout,
+		encoding:          c.encoding,
+		aw:                state.NewAccessWitness(nil),
+		enableChunksStats: enableChunksStats,
+		chunksStats:       analysis.NewChunksStatsRecorder(),
+		contracts:         map[common.Address]contractInfo{},
+		contractsGas:      map[common.Address]uint64{},
+		lastPCs:           map[common.Address]uint64{},
+		contractBytecodes: contractBytecodes,
+	}
+	for _, addr := range touchedContracts {
+		// The touched contracts are the tx destination, or contracts that are called by the tx.
+		// In any case, we warm those accounts headers since tx destination or *CALL targets will
+		// access the account header branch for at least CodeSize reasons.
+		c.aw.TouchTxExistingAndComputeGas(addr.Bytes(), false)
+
+		code := contractBytecodes[addr]
+		info := contractInfo{treeKeyAddr: c.layout.TreeKeyAddress(addr, code)}
+		if container, err := eof.Parse(code); err == nil {
+			info.eofExecution = eof.NewExecution(container, code)
+			info.chunkedSize = container.ChunkedSize()
+			c.contracts[addr] = info
+			continue
+		}
+
+		info.numCodeChunks = uint64((len(code) + 31) / 32)
+		bitmaps := pushdataBitmaps(code)
+		for i := len(bitmaps) - 1; i >= 0; i-- {
+			if c.needsEntry(code, i, bitmaps[i]) {
+				info.numTableEntries = uint64(i + 1)
+				break
+			}
+		}
+		switch c.encoding {
+		case PushdataBitmap:
+			info.tableSize = int(info.numTableEntries) * 4
+		case FalseJumpdestBitset:
+			info.tableSize = int(info.numTableEntries+7) / 8
+		}
+		tableLeaves := (info.tableSize + 31) / 32
+		info.chunkedSize = (int(info.numCodeChunks) + tableLeaves) * 32
+		c.contracts[addr] = info
+	}
+	return nil
+}
+
+func (c *Chunker) AccessPC(addr common.Address, pc uint64) error {
+	info := c.contracts[addr]
+	if info.eofExecution != nil {
+		chunkNumber, chunkOffset, ok := info.eofExecution.ChunkNumber(pc)
+		if !ok {
+			return fmt.Errorf("pc %d is outside of the executed EOF code section of %v", pc, addr)
+		}
+		gas, branchGas := analysis.TouchCodeChunk(c.aw, c.layout, info.treeKeyAddr, chunkNumber)
+		c.chargeGas(addr, gas, branchGas)
+		return c.recordChunkStats(addr, int(chunkNumber), 1<<chunkOffset, gas)
+	}
+
+	code := c.contractBytecodes[addr]
+	gas, branchGas := analysis.TouchCodeChunksRange(c.aw, c.layout, info.treeKeyAddr, pc, 1, uint64(len(code)), 32, 0)
+	c.chargeGas(addr, gas, branchGas)
+	if err := c.recordChunkStats(addr, int(pc/32), 1<<(pc%32), gas); err != nil {
+		return err
+	}
+
+	// PCs of a contract are accessed in execution order, so the previous PC tells if pc is a
+	// jump destination, whose entry is read to check it isn't PUSHDATA.
+	lastPC, ok := c.lastPCs[addr]
+	c.lastPCs[addr] = pc
+	codeChunk := pc / 32
+	if !ok || !analysis.JumpLanding(code, lastPC, pc) || codeChunk >= info.numTableEntries {
+		return nil
+	}
+	var tableLeaf uint64
+	var entryBytes uint32
+	switch c.encoding {
+	case PushdataBitmap:
+		tableLeaf = codeChunk / 8
+		entryBytes = analysis.BytesRange(int(codeChunk%8)*4, int(codeChunk%8)*4+4)
+	case FalseJumpdestBitset:
+		tableLeaf = codeChunk / 256
+		entryBytes = analysis.BytesRange(int(codeChunk%256)/8, int(codeChunk%256)/8+1)
+	}
+	gas, branchGas = analysis.TouchCodeChunk(c.aw, c.layout, info.treeKeyAddr, info.numCodeChunks+tableLeaf)
+	c.chargeGas(addr, gas, branchGas)
+	c.tableChunksTouched += analysis.ChargedChunks(gas, branchGas)
+
+	return c.recordChunkStats(addr, int(info.numCodeChunks+tableLeaf), entryBytes, gas)
+}
+
+func (c *Chunker) recordChunkStats(addr common.Address, chunkNumber int, accessedBytes uint32, chargedGas uint64) error {
+	if !c.enableChunksStats {
+		return nil
+	}
+	return c.chunksStats.Record(addr, chunkNumber, accessedBytes, chargedGas)
+}
+
+func (c *Chunker) GetReport() analysis.ChunkerMetrics {
+	contractStats := make(map[common.Address]analysis.ContractStats, len(c.contracts))
+	for addr, info := range c.contracts {
+		contractStats[addr] = analysis.ContractStats{
+			Gas:              c.contractsGas[addr],
+			ChunkedSizeBytes: info.chunkedSize,
+			TableSizeBytes:   info.tableSize,
+			ChunksStats:      c.chunksStats.ChunksStats(addr),
+		}
+	}
+	return analysis.ChunkerMetrics{
+		ChunkerName:        c.Name(),
+		Gas:                c.gas,
+		BranchGas:          c.branchGas,
+		ContractsStats:     contractStats,
+		TableChunksTouched: c.tableChunksTouched,
+	}
+}
+
+func (c *Chunker) chargeGas(addr common.Address, gas, branchGas uint64) {
+	c.gas += gas
+	c.contractsGas[addr] += gas
+	c.branchGas += branchGas
+}
+
+// needsEntry returns true if the code chunk needs a non-zero entry in the table.
+func (c *Chunker) needsEntry(code []byte, codeChunk int, bitmap uint32) bool {
+	if c.encoding == PushdataBitmap {
+		return bitmap != 0
+	}
+	for i := 0; i < 32 && codeChunk*32+i < len(code); i++ {
+		if bitmap&(1<<i) != 0 && code[codeChunk*32+i] == JUMPDEST {
+			return true
+		}
+	}
+	return false
+}
+
+// pushdataBitmaps returns, for every 32-byte code chunk, a bitmap marking which bytes are PUSHDATA.
+func pushdataBitmaps(code []byte) []uint32 {
+	bitmaps := make([]uint32, (len(code)+31)/32)
+	for i := 0; i < len(code); {
+		if code[i] < PUSH1 || code[i] > PUSH32 {
+			i++
+			continue
+		}
+		pushDataEnd := i + int(code[i]-PUSH1+1)
+		for i++; i <= pushDataEnd && i < len(code); i++ {
+			bitmaps[i/32] |= 1 << (i % 32)
+		}
+	}
+	return bitmaps
+}
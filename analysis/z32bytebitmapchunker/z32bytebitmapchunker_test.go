@@ -0,0 +1,105 @@
+package z32bytebitmapchunker
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/analysis/z32bytechunker"
+)
+
+func FuzzPushdataBitmapsRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{PUSH1, JUMPDEST})
+	f.Add(append([]byte{PUSH32}, make([]byte, 64)...))
+	f.Add(append(make([]byte, 31), PUSH32, JUMPDEST, JUMPDEST))
+	f.Fuzz(func(t *testing.T, code []byte) {
+		bitmaps := pushdataBitmaps(code)
+		if len(bitmaps) != (len(code)+31)/32 {
+			t.Fatalf("expected %d bitmaps, got %d", (len(code)+31)/32, len(bitmaps))
+		}
+		var decoded []int
+		for i := range code {
+			if bitmaps[i/32]&(1<<(i%32)) != 0 && code[i] == JUMPDEST {
+				decoded = append(decoded, i)
+			}
+		}
+		expected := z32bytechunker.InvalidJumpdests(code)
+		if !slices.Equal(decoded, expected) {
+			t.Fatalf("expected invalid jumpdests %v, decoded %v", expected, decoded)
+		}
+
+		// The bitset marks the code chunks with invalid JUMPDESTs.
+		bitset := New(analysis.DefaultCodeKeyLayout, FalseJumpdestBitset)
+		for i, bitmap := range bitmaps {
+			hasInvalidJumpdest := slices.ContainsFunc(expected, func(pos int) bool { return pos/32 == i })
+			if needsEntry := bitset.needsEntry(code, i, bitmap); needsEntry != hasInvalidJumpdest {
+				t.Fatalf("code chunk %d: expected entry %v, got %v", i, hasInvalidJumpdest, needsEntry)
+			}
+		}
+	})
+}
+
+func TestTableJumpLanding(t *testing.T) {
+	// Code chunks 1 to 15 start with PUSH1 0x5b, so the first 16 have a table entry and the last
+	// 4 don't. The bitmaps take 2 leaves of 8 entries, and the bitset a single leaf. The code
+	// jumps from chunk 0 to a JUMPDEST at dest, or runs straight into it if it's a STOP.
+	const numCodeChunks = 20
+	newCode := func(dest int, destOp byte) []byte {
+		code := make([]byte, numCodeChunks*32)
+		for chunk := 1; chunk < 16; chunk++ {
+			code[chunk*32], code[chunk*32+1] = PUSH1, JUMPDEST
+		}
+		copy(code, []byte{PUSH1, JUMPDEST, PUSH1 + 1, byte(dest >> 8), byte(dest), 0x56})
+		code[dest] = destOp
+		return code
+	}
+	contract := common.HexToAddress("0xc0de")
+
+	tests := []struct {
+		name        string
+		encoding    Encoding
+		code        []byte
+		chunkedSize int
+		// leafChunk is the chunk of the touched table leaf, or -1 if none is touched.
+		leafChunk int
+	}{
+		{name: "bitmap landing", encoding: PushdataBitmap, code: newCode(9*32+2, JUMPDEST), chunkedSize: 22 * 32, leafChunk: 21},
+		{name: "bitmap landing without entry", encoding: PushdataBitmap, code: newCode(17*32+2, JUMPDEST), chunkedSize: 22 * 32, leafChunk: -1},
+		{name: "bitmap without landing", encoding: PushdataBitmap, code: newCode(9*32+2, 0x00), chunkedSize: 22 * 32, leafChunk: -1},
+		{name: "bitset landing", encoding: FalseJumpdestBitset, code: newCode(9*32+2, JUMPDEST), chunkedSize: 21 * 32, leafChunk: 20},
+	}
+	for _, test := range tests {
+		chunker := New(analysis.DefaultCodeKeyLayout, test.encoding)
+		if err := chunker.Init([]common.Address{contract}, map[common.Address][]byte{contract: test.code}, true); err != nil {
+			t.Fatal(err)
+		}
+		dest := uint64(test.code[3])<<8 | uint64(test.code[4])
+		for _, pc := range []uint64{0, 2, 5, dest} {
+			if err := chunker.AccessPC(contract, pc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		report := chunker.GetReport()
+		stats := report.ContractsStats[contract]
+		if stats.ChunkedSizeBytes != test.chunkedSize {
+			t.Fatalf("%s: expected chunked size %d, got %d", test.name, test.chunkedSize, stats.ChunkedSizeBytes)
+		}
+		var leafChunks []int
+		for _, chunkStats := range stats.ChunksStats {
+			if chunkStats.ChunkNumber >= numCodeChunks {
+				leafChunks = append(leafChunks, chunkStats.ChunkNumber)
+				if chunkStats.ChargedGas == 0 {
+					t.Fatalf("%s: table leaf chunk %d wasn't charged", test.name, chunkStats.ChunkNumber)
+				}
+			}
+		}
+		switch {
+		case test.leafChunk == -1 && (len(leafChunks) != 0 || report.TableChunksTouched != 0):
+			t.Fatalf("%s: expected no table leaf touched, got %v", test.name, leafChunks)
+		case test.leafChunk != -1 && (!slices.Equal(leafChunks, []int{test.leafChunk}) || report.TableChunksTouched != 1):
+			t.Fatalf("%s: expected table leaf chunk %d touched, got %v", test.name, test.leafChunk, leafChunks)
+		}
+	}
+}
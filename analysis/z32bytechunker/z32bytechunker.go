@@ -1,31 +1,64 @@
 package z32bytechunker
 
 import (
+	"fmt"
+
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/core/state"
-	"github.com/holiman/uint256"
 	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/analysis/eof"
 )
 
 type Chunker struct {
+	layout analysis.CodeKeyLayout
+	// lazyTable makes the JUMPDEST table to be charged only when a JUMP/JUMPI lands in a
+	// code chunk with a table entry, instead of charging the whole table up front.
+	lazyTable bool
+
 	contractBytecodes map[common.Address][]byte
 	aw                *state.AccessWitness
+	enableChunksStats bool
+	chunksStats       *analysis.ChunksStatsRecorder
+
+	gas                uint64
+	branchGas          uint64
+	tableChunksTouched uint64
+	contractsGas       map[common.Address]uint64
+	chunkedSizes       map[common.Address]int
+	tableSizes         map[common.Address]int
+	contractPCShift    map[common.Address]int
+	eofExecutions      map[common.Address]*eof.Execution
+	treeKeyAddrs       map[common.Address][]byte
+	tableEntryEnds     map[common.Address]map[int]int
+	lastPCs            map[common.Address]uint64
+}
 
-	gas             uint64
-	chunkedSizes    map[common.Address]int
-	contractPCShift map[common.Address]int
+func New(layout analysis.CodeKeyLayout, lazyTable bool) *Chunker {
+	return &Chunker{layout: layout, lazyTable: lazyTable}
 }
 
-func New() *Chunker {
-	return &Chunker{}
+func (c *Chunker) Name() string {
+	if c.lazyTable {
+		return analysis.ChunkerName("32bytelazytablechunker", c.layout)
+	}
+	return analysis.ChunkerName("32bytechunker", c.layout)
 }
 
-func (c *Chunker) Init(touchedContracts []common.Address, contractBytecodes map[common.Address][]byte, _ bool) error {
+func (c *Chunker) Init(touchedContracts []common.Address, contractBytecodes map[common.Address][]byte, enableChunksStats bool) error {
 	*c = Chunker{
+		layout:            c.layout,
+		lazyTable:         c.lazyTable,
 		aw:                state.NewAccessWitness(nil),
+		enableChunksStats: enableChunksStats,
+		chunksStats:       analysis.NewChunksStatsRecorder(),
+		contractsGas:      map[common.Address]uint64{},
 		chunkedSizes:      map[common.Address]int{},
+		tableSizes:        map[common.Address]int{},
 		contractPCShift:   map[common.Address]int{},
+		eofExecutions:     map[common.Address]*eof.Execution{},
+		treeKeyAddrs:      map[common.Address][]byte{},
+		tableEntryEnds:    map[common.Address]map[int]int{},
+		lastPCs:           map[common.Address]uint64{},
 		contractBytecodes: contractBytecodes,
 	}
 	for _, addr := range touchedContracts {
@@ -33,15 +66,33 @@ func (c *Chunker) Init(touchedContracts []common.Address, contractBytecodes map[
 		// In any case, we warm those accounts headers since tx destination or *CALL targets will
 		// access the account header branch for at least CodeSize reasons.
 		c.aw.TouchTxExistingAndComputeGas(addr.Bytes(), false)
+		c.treeKeyAddrs[addr] = c.layout.TreeKeyAddress(addr, contractBytecodes[addr])
+
+		// EOF containers are validated at deploy time, so they don't need a JUMPDEST table.
+		// Invalid containers are treated as legacy code.
+		if container, err := eof.Parse(contractBytecodes[addr]); err == nil {
+			c.eofExecutions[addr] = eof.NewExecution(container, contractBytecodes[addr])
+			c.chunkedSizes[addr] = container.ChunkedSize()
+			continue
+		}
 
 		// Generate JUMPDEST table and place it at the start in the account header, and calculate the shift for the
 		// rest of contract bytecodes for later `pc` mappings.
-		table := chunkifyCodeInvalidJumpdests(contractBytecodes[addr])
+		encoder := encodeInvalidJumpdests(contractBytecodes[addr])
+		table := encoder.encodedTable()
 		var buf [3]byte
 		tableSizeEncoded := leb128Encode(buf[:], len(table))
 		totalTableSize := tableSizeEncoded + len(table)
-		c.gas += c.aw.TouchCodeChunksRangeAndChargeGas(addr.Bytes(), 0, uint64(totalTableSize), uint64(totalTableSize), false)
+		if c.lazyTable {
+			c.tableEntryEnds[addr] = make(map[int]int, len(encoder.entryEnds))
+			for codeChunk, end := range encoder.entryEnds {
+				c.tableEntryEnds[addr][codeChunk] = tableSizeEncoded + end
+			}
+		} else if err := c.touchTable(addr, totalTableSize); err != nil {
+			return err
+		}
 		c.contractPCShift[addr] = totalTableSize
+		c.tableSizes[addr] = totalTableSize
 
 		// Record contract chunked size, aligned to 32-bytes.
 		c.chunkedSizes[addr] = totalTableSize + len(contractBytecodes[addr])
@@ -53,58 +104,87 @@ func (c *Chunker) Init(touchedContracts []common.Address, contractBytecodes map[
 }
 
 func (c *Chunker) AccessPC(addr common.Address, pc uint64) error {
-	gas := c.touchCodeChunksRangeAndChargeGas(c.aw, addr.Bytes(), pc, 1, uint64(len(c.contractBytecodes[addr])), false)
-	c.gas += gas
+	if execution, ok := c.eofExecutions[addr]; ok {
+		chunkNumber, chunkOffset, ok := execution.ChunkNumber(pc)
+		if !ok {
+			return fmt.Errorf("pc %d is outside of the executed EOF code section of %v", pc, addr)
+		}
+		gas, branchGas := analysis.TouchCodeChunk(c.aw, c.layout, c.treeKeyAddrs[addr], chunkNumber)
+		c.chargeGas(addr, gas, branchGas)
+		return c.recordChunkStats(addr, int(chunkNumber), 1<<chunkOffset, gas)
+	}
+
+	shift := uint64(c.contractPCShift[addr])
+	gas, branchGas := analysis.TouchCodeChunksRange(c.aw, c.layout, c.treeKeyAddrs[addr], pc, 1, uint64(len(c.contractBytecodes[addr])), 32, shift)
+	c.chargeGas(addr, gas, branchGas)
+	if err := c.recordChunkStats(addr, int((pc+shift)/32), 1<<((pc+shift)%32), gas); err != nil {
+		return err
+	}
+
+	if c.lazyTable {
+		// PCs of a contract are accessed in execution order, so the previous PC tells if pc is a
+		// jump destination. Entries are delta-encoded, so looking up the entry of the destination
+		// code chunk requires reading the table from the start.
+		if lastPC, ok := c.lastPCs[addr]; ok && analysis.JumpLanding(c.contractBytecodes[addr], lastPC, pc) {
+			if end, ok := c.tableEntryEnds[addr][int(pc/32)]; ok {
+				if err := c.touchTable(addr, end); err != nil {
+					return err
+				}
+			}
+		}
+		c.lastPCs[addr] = pc
+	}
+	return nil
+}
+
+// touchTable touches the first size bytes of the JUMPDEST table of the contract.
+func (c *Chunker) touchTable(addr common.Address, size int) error {
+	for chunkNumber := 0; chunkNumber*32 < size; chunkNumber++ {
+		gas, branchGas := analysis.TouchCodeChunk(c.aw, c.layout, c.treeKeyAddrs[addr], uint64(chunkNumber))
+		c.chargeGas(addr, gas, branchGas)
+		c.tableChunksTouched += analysis.ChargedChunks(gas, branchGas)
+		if err := c.recordChunkStats(addr, chunkNumber, analysis.BytesRange(0, min(size-chunkNumber*32, 32)), gas); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func (c *Chunker) recordChunkStats(addr common.Address, chunkNumber int, accessedBytes uint32, chargedGas uint64) error {
+	if !c.enableChunksStats {
+		return nil
+	}
+	return c.chunksStats.Record(addr, chunkNumber, accessedBytes, chargedGas)
+}
+
 func (c *Chunker) GetReport() analysis.ChunkerMetrics {
 	contractStats := make(map[common.Address]analysis.ContractStats)
 	for addr, size := range c.chunkedSizes {
 		contractStats[addr] = analysis.ContractStats{
+			Gas:              c.contractsGas[addr],
 			ChunkedSizeBytes: size,
+			TableSizeBytes:   c.tableSizes[addr],
+			ChunksStats:      c.chunksStats.ChunksStats(addr),
 		}
 	}
 	return analysis.ChunkerMetrics{
-		ChunkerName:    "32bytechunker",
-		Gas:            c.gas,
-		ContractsStats: contractStats,
+		ChunkerName:        c.Name(),
+		Gas:                c.gas,
+		BranchGas:          c.branchGas,
+		ContractsStats:     contractStats,
+		TableChunksTouched: c.tableChunksTouched,
 	}
 }
 
-func (c *Chunker) touchCodeChunksRangeAndChargeGas(aw *state.AccessWitness, contractAddr []byte, startPC, size uint64, codeLen uint64, isWrite bool) uint64 {
-	if (codeLen == 0 && size == 0) || startPC > codeLen {
-		return 0
-	}
-
-	endPC := startPC + size
-	if endPC > codeLen {
-		endPC = codeLen
-	}
-	if endPC > 0 {
-		endPC -= 1 // endPC is the last bytecode that will be touched.
-	}
-
-	shift := uint64(c.contractPCShift[common.BytesToAddress(contractAddr)])
-	startPC += shift
-	endPC += shift
-
-	var statelessGasCharged uint64
-	for chunkNumber := startPC / 32; chunkNumber <= endPC/32; chunkNumber++ {
-		treeIndex := *uint256.NewInt((chunkNumber + 128) / 256)
-		subIndex := byte((chunkNumber + 128) % 256)
-		gas := aw.TouchAddressAndChargeGas(contractAddr, treeIndex, subIndex, isWrite)
-		var overflow bool
-		statelessGasCharged, overflow = math.SafeAdd(statelessGasCharged, gas)
-		if overflow {
-			panic("overflow when adding gas")
-		}
-	}
-
-	return statelessGasCharged
+func (c *Chunker) chargeGas(addr common.Address, gas, branchGas uint64) {
+	c.gas += gas
+	c.contractsGas[addr] += gas
+	c.branchGas += branchGas
 }
 
 const (
+	JUMP     = byte(0x56)
+	JUMPI    = byte(0x57)
 	PUSH1    = byte(0x60)
 	PUSH32   = byte(0x7f)
 	JUMPDEST = byte(0x5b)
@@ -113,6 +193,8 @@ const (
 type TableInvalidJumpdestEncoder struct {
 	table         []byte
 	lastCodeChunk int
+	// entryEnds maps every code chunk with an entry to the table offset where the entry ends.
+	entryEnds map[int]int
 
 	// used to do leb128 encoding without allocations
 	buf [3]byte
@@ -120,7 +202,8 @@ type TableInvalidJumpdestEncoder struct {
 
 func NewTableInvalidJumpdestEncoder() TableInvalidJumpdestEncoder {
 	return TableInvalidJumpdestEncoder{
-		table: make([]byte, 0, 32),
+		table:     make([]byte, 0, 32),
+		entryEnds: map[int]int{},
 	}
 }
 
@@ -130,6 +213,7 @@ func (enc *TableInvalidJumpdestEncoder) append(codeChunk int, firstValidInstruct
 	size := leb128Encode(enc.buf[:], e)
 	enc.table = append(enc.table, enc.buf[:size]...)
 	enc.lastCodeChunk = codeChunk
+	enc.entryEnds[codeChunk] = len(enc.table)
 }
 
 func (enc *TableInvalidJumpdestEncoder) encodedTable() []byte {
@@ -139,6 +223,11 @@ func (enc *TableInvalidJumpdestEncoder) encodedTable() []byte {
 // chunkifyCodeInvalidJumpdests returns the table of invalid jumpdests in the code.
 // Note that the actual code-chunking is always a 32-byte slicing of the original code.
 func chunkifyCodeInvalidJumpdests(code []byte) []byte {
+	encoder := encodeInvalidJumpdests(code)
+	return encoder.encodedTable()
+}
+
+func encodeInvalidJumpdests(code []byte) TableInvalidJumpdestEncoder {
 	encoder := NewTableInvalidJumpdestEncoder()
 
 	var addedEntry bool
@@ -168,7 +257,7 @@ func chunkifyCodeInvalidJumpdests(code []byte) []byte {
 			}
 		}
 	}
-	return encoder.encodedTable()
+	return encoder
 }
 
 func leb128Encode(buf []byte, value int) int {
@@ -188,3 +277,129 @@ func leb128Encode(buf []byte, value int) int {
 	}
 	return i
 }
+
+// TableEntry is an entry of the invalid JUMPDEST table, for a 32-byte code chunk that
+// contains a JUMPDEST byte in PUSHDATA.
+type TableEntry struct {
+	CodeChunk                   int
+	FirstValidInstructionOffset int
+}
+
+// DecodeTableInvalidJumpdests decodes the entries of a table generated by chunkifyCodeInvalidJumpdests.
+func DecodeTableInvalidJumpdests(table []byte) ([]TableEntry, error) {
+	var entries []TableEntry
+	var lastCodeChunk int
+	for pos := 0; pos < len(table); {
+		e, size, err := leb128Decode(table[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry at offset %d: %s", pos, err)
+		}
+		pos += size
+		delta, offset := e/33, e%33
+		if len(entries) > 0 && delta == 0 {
+			return nil, fmt.Errorf("duplicated entry for code chunk %d at offset %d", lastCodeChunk, pos-size)
+		}
+		lastCodeChunk += delta
+		entries = append(entries, TableEntry{CodeChunk: lastCodeChunk, FirstValidInstructionOffset: offset})
+	}
+	return entries, nil
+}
+
+// DecodeInvalidJumpdests rebuilds the sorted positions of JUMPDEST bytes in PUSHDATA from the
+// table and the code. Code chunks without an entry don't have invalid JUMPDESTs, and chunks with
+// an entry are analyzed starting from their first valid instruction.
+func DecodeInvalidJumpdests(table []byte, code []byte) ([]int, error) {
+	entries, err := DecodeTableInvalidJumpdests(table)
+	if err != nil {
+		return nil, err
+	}
+	var invalidJumpdests []int
+	for _, entry := range entries {
+		chunkStart := entry.CodeChunk * 32
+		if chunkStart >= len(code) {
+			return nil, fmt.Errorf("entry for code chunk %d is out of the code", entry.CodeChunk)
+		}
+		chunkEnd := min(chunkStart+32, len(code))
+		for i := chunkStart; i < min(chunkStart+entry.FirstValidInstructionOffset, chunkEnd); i++ {
+			if code[i] == JUMPDEST {
+				invalidJumpdests = append(invalidJumpdests, i)
+			}
+		}
+		for i := chunkStart + entry.FirstValidInstructionOffset; i < chunkEnd; {
+			if code[i] < PUSH1 || code[i] > PUSH32 {
+				i++
+				continue
+			}
+			pushDataEnd := i + int(code[i]-PUSH1+1)
+			for i++; i <= pushDataEnd && i < chunkEnd; i++ {
+				if code[i] == JUMPDEST {
+					invalidJumpdests = append(invalidJumpdests, i)
+				}
+			}
+		}
+	}
+	return invalidJumpdests, nil
+}
+
+// TableInvalidJumpdests returns the entries of the invalid JUMPDEST table of the code, and the
+// number of bytes the table takes before the code, including its encoded length.
+func TableInvalidJumpdests(code []byte) ([]TableEntry, int, error) {
+	table := chunkifyCodeInvalidJumpdests(code)
+	entries, err := DecodeTableInvalidJumpdests(table)
+	if err != nil {
+		return nil, 0, err
+	}
+	var buf [3]byte
+	return entries, leb128Encode(buf[:], len(table)) + len(table), nil
+}
+
+// InvalidJumpdests returns the sorted positions of JUMPDEST bytes in PUSHDATA, doing a
+// straightforward JUMPDEST analysis of the code.
+func InvalidJumpdests(code []byte) []int {
+	var invalidJumpdests []int
+	for i := 0; i < len(code); {
+		if code[i] < PUSH1 || code[i] > PUSH32 {
+			i++
+			continue
+		}
+		pushDataEnd := i + int(code[i]-PUSH1+1)
+		for i++; i <= pushDataEnd && i < len(code); i++ {
+			if code[i] == JUMPDEST {
+				invalidJumpdests = append(invalidJumpdests, i)
+			}
+		}
+	}
+	return invalidJumpdests
+}
+
+// ValidateTableInvalidJumpdests checks that the invalid JUMPDESTs decoded from the table of the
+// code match a straightforward JUMPDEST analysis of it.
+func ValidateTableInvalidJumpdests(code []byte) error {
+	expected := InvalidJumpdests(code)
+	decoded, err := DecodeInvalidJumpdests(chunkifyCodeInvalidJumpdests(code), code)
+	if err != nil {
+		return fmt.Errorf("decoding table: %s", err)
+	}
+	for i := 0; i < max(len(expected), len(decoded)); i++ {
+		switch {
+		case i >= len(decoded):
+			return fmt.Errorf("invalid JUMPDEST at %d is missing in the table", expected[i])
+		case i >= len(expected):
+			return fmt.Errorf("table has an unexpected invalid JUMPDEST at %d", decoded[i])
+		case expected[i] != decoded[i]:
+			return fmt.Errorf("expected invalid JUMPDEST at %d, table has %d", expected[i], decoded[i])
+		}
+	}
+	return nil
+}
+
+func leb128Decode(buf []byte) (int, int, error) {
+	var value int
+	for i := 0; i < len(buf) && i < 3; i++ {
+		value |= int(buf[i]&0x7f) << (7 * i)
+		if buf[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("unterminated leb128 value")
+}
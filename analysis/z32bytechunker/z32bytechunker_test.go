@@ -0,0 +1,156 @@
+package z32bytechunker
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+)
+
+func FuzzInvalidJumpdestsTableRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{PUSH1, JUMPDEST})
+	f.Add(append([]byte{PUSH32}, make([]byte, 64)...))
+	f.Add(append(make([]byte, 31), PUSH32, JUMPDEST, JUMPDEST))
+	f.Fuzz(func(t *testing.T, code []byte) {
+		table := chunkifyCodeInvalidJumpdests(code)
+		decoded, err := DecodeInvalidJumpdests(table, code)
+		if err != nil {
+			t.Fatalf("decoding table %x: %s", table, err)
+		}
+		if expected := InvalidJumpdests(code); !slices.Equal(decoded, expected) {
+			t.Fatalf("expected invalid jumpdests %v, decoded %v", expected, decoded)
+		}
+
+		entries, err := DecodeTableInvalidJumpdests(table)
+		if err != nil {
+			t.Fatalf("decoding table entries: %s", err)
+		}
+		for i, entry := range entries {
+			if entry.FirstValidInstructionOffset > 32 {
+				t.Fatalf("entry %d has an invalid first instruction offset %d", i, entry.FirstValidInstructionOffset)
+			}
+			if i > 0 && entry.CodeChunk <= entries[i-1].CodeChunk {
+				t.Fatalf("entry %d isn't sorted by code chunk", i)
+			}
+		}
+	})
+}
+
+func FuzzLEB128RoundTrip(f *testing.F) {
+	f.Add(0)
+	f.Add(127)
+	f.Add(128)
+	f.Add(1<<21 - 1)
+	f.Fuzz(func(t *testing.T, value int) {
+		if value < 0 || value >= 1<<21 {
+			t.Skip()
+		}
+		var buf [3]byte
+		size := leb128Encode(buf[:], value)
+		decoded, decodedSize, err := leb128Decode(buf[:size])
+		if err != nil {
+			t.Fatalf("decoding %x: %s", buf[:size], err)
+		}
+		if decoded != value || decodedSize != size {
+			t.Fatalf("expected %d (%d bytes), got %d (%d bytes)", value, size, decoded, decodedSize)
+		}
+	})
+}
+
+func TestDecodeTableInvalidJumpdestsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		table []byte
+	}{
+		{name: "unterminated", table: []byte{0x80}},
+		{name: "too long", table: []byte{0x80, 0x80, 0x80, 0x01}},
+		{name: "duplicated chunk", table: []byte{33, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := DecodeTableInvalidJumpdests(test.table); err == nil {
+				t.Fatalf("expected error decoding %x", test.table)
+			}
+		})
+	}
+}
+
+func TestLazyTableJumpLanding(t *testing.T) {
+	// All the code chunks start with PUSH1 0x5b, so all of them have a table entry and the table
+	// takes four chunks, the last shared with the code. The code jumps from chunk 0 to the
+	// JUMPDEST at offset 2 of chunk 2, whose entry is in the first table chunk.
+	code := make([]byte, 120*32)
+	for chunk := 1; chunk < 120; chunk++ {
+		code[chunk*32], code[chunk*32+1] = PUSH1, JUMPDEST
+	}
+	const dest = 2*32 + 2
+	code[dest] = JUMPDEST
+	copy(code, []byte{PUSH1, JUMPDEST, 0x50, PUSH1, dest, JUMP})
+	contract := common.HexToAddress("0xc0de")
+	bytecodes := map[common.Address][]byte{contract: code}
+
+	run := func(lazyTable bool, pcs []uint64) analysis.ChunkerMetrics {
+		chunker := New(analysis.DefaultCodeKeyLayout, lazyTable)
+		if err := chunker.Init([]common.Address{contract}, bytecodes, false); err != nil {
+			t.Fatal(err)
+		}
+		for _, pc := range pcs {
+			if err := chunker.AccessPC(contract, pc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return chunker.GetReport()
+	}
+
+	jump := []uint64{0, 2, 3, 5, dest, dest + 1}
+	eager, lazy := run(false, jump), run(true, jump)
+	if eager.TableChunksTouched != 4 || lazy.TableChunksTouched != 1 {
+		t.Fatalf("expected 4 eager and 1 lazy table chunks touched, got %d and %d", eager.TableChunksTouched, lazy.TableChunksTouched)
+	}
+	if lazy.Gas >= eager.Gas {
+		t.Fatalf("expected lazy gas %d to be lower than eager gas %d", lazy.Gas, eager.Gas)
+	}
+
+	// A later call to the contract starts at PC 0 right after the JUMP, which isn't a landing.
+	if nextCall := run(true, []uint64{0, 2, 3, 5, 0}); nextCall.TableChunksTouched != 0 {
+		t.Fatalf("expected the start of a later call not to touch the table, got %d chunks", nextCall.TableChunksTouched)
+	}
+}
+
+func TestLazyTableJumpToNextByte(t *testing.T) {
+	// As in TestLazyTableJumpLanding, every code chunk has a table entry, and the table takes four
+	// chunks. The cases run in code chunk 5, whose entry is only in the first table chunk.
+	const base = 5*32 + 2
+	contract := common.HexToAddress("0xc0de")
+	tests := []struct {
+		name    string
+		code    []byte
+		pcs     []uint64
+		touched uint64
+	}{
+		{name: "JUMP", code: []byte{PUSH1, base + 3, JUMP, JUMPDEST}, pcs: []uint64{0, 2, 3}, touched: 1},
+		{name: "taken JUMPI", code: []byte{PUSH1, 1, PUSH1, base + 6, JUMPI, 0x00, JUMPDEST}, pcs: []uint64{0, 2, 4, 6}, touched: 1},
+		{name: "JUMPI not taken", code: []byte{PUSH1, 0, PUSH1, base + 5, JUMPI, JUMPDEST}, pcs: []uint64{0, 2, 4, 5}, touched: 0},
+	}
+	for _, test := range tests {
+		code := make([]byte, 120*32)
+		for chunk := 1; chunk < 120; chunk++ {
+			code[chunk*32], code[chunk*32+1] = PUSH1, JUMPDEST
+		}
+		copy(code[base:], test.code)
+		chunker := New(analysis.DefaultCodeKeyLayout, true)
+		if err := chunker.Init([]common.Address{contract}, map[common.Address][]byte{contract: code}, false); err != nil {
+			t.Fatal(err)
+		}
+		for _, pc := range test.pcs {
+			if err := chunker.AccessPC(contract, base+pc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if touched := chunker.GetReport().TableChunksTouched; touched != test.touched {
+			t.Fatalf("%s: expected %d table chunks touched, got %d", test.name, test.touched, touched)
+		}
+	}
+}
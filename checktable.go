@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis/z32bytechunker"
+	"golang.org/x/sync/errgroup"
+)
+
+type tableMismatch struct {
+	contractAddr     common.Address
+	codeSize         int
+	invalidJumpdests int
+	err              error
+}
+
+// runCheckTable validates the invalid JUMPDEST table encoding of the 32-byte chunker against a
+// straightforward JUMPDEST analysis of every contract in the code corpus.
+func runCheckTable(args []string) error {
+	flags := flag.NewFlagSet("checktable", flag.ExitOnError)
+	pcTraceFolderFlag := flags.String("tracespath", "", "Full path of the folder containing the traces")
+	outFlag := flags.String("out", ".", "Folder where the generated files are written")
+	runIDFlag := flags.String("run-id", "", "Prefix for the names of the generated files, to keep the results of different runs apart")
+	formatFlag := flags.String("format", formatCSV, fmt.Sprintf("Format of the generated table (%s)", strings.Join(tableFormats, "|")))
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *pcTraceFolderFlag == "" {
+		return fmt.Errorf("expected --tracespath <folder> flag")
+	}
+	if !slices.Contains(tableFormats, *formatFlag) {
+		return fmt.Errorf("unsupported output format %s", *formatFlag)
+	}
+	out := outputFiles{dir: *outFlag, runID: *runIDFlag, format: *formatFlag}
+	if err := os.MkdirAll(out.dir, 0755); err != nil {
+		return fmt.Errorf("could not create output folder: %s", err)
+	}
+
+	contractBytecodes, err := loadContractBytecodes(*pcTraceFolderFlag)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Validating JUMPDEST tables... ")
+	var lock sync.Mutex
+	var mismatches []tableMismatch
+	group, _ := errgroup.WithContext(context.Background())
+	group.SetLimit(runtime.NumCPU())
+	for contractAddr, code := range contractBytecodes {
+		contractAddr, code := contractAddr, code
+		group.Go(func() error {
+			if err := z32bytechunker.ValidateTableInvalidJumpdests(code); err != nil {
+				lock.Lock()
+				mismatches = append(mismatches, tableMismatch{
+					contractAddr:     contractAddr,
+					codeSize:         len(code),
+					invalidJumpdests: len(z32bytechunker.InvalidJumpdests(code)),
+					err:              err,
+				})
+				lock.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("error validating tables: %s", err)
+	}
+	fmt.Printf("OK\n")
+	sort.Slice(mismatches, func(i, j int) bool {
+		return bytes.Compare(mismatches[i].contractAddr[:], mismatches[j].contractAddr[:]) < 0
+	})
+
+	if err := genTableMismatchesTable(mismatches, out); err != nil {
+		return fmt.Errorf("error exporting table mismatches: %s", err)
+	}
+	fmt.Printf("Validated %d contracts, %d have mismatches\n", len(contractBytecodes), len(mismatches))
+	if len(mismatches) > 0 {
+		return fmt.Errorf("found %d contracts with mismatching JUMPDEST tables", len(mismatches))
+	}
+	return nil
+}
+
+func genTableMismatchesTable(mismatches []tableMismatch, out outputFiles) (err error) {
+	columns := []column{
+		{name: "contract_addr", kind: columnAddress},
+		{name: "code_size", kind: columnInt},
+		{name: "invalid_jumpdests", kind: columnInt},
+		{name: "error", kind: columnString},
+	}
+	mismatchesTable, err := out.createTable("jumpdest_table_mismatches", columns)
+	if err != nil {
+		return err
+	}
+	defer closeTable(mismatchesTable, &err)
+	for _, mismatch := range mismatches {
+		row := []any{mismatch.contractAddr, mismatch.codeSize, mismatch.invalidJumpdests, mismatch.err.Error()}
+		if err := mismatchesTable.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
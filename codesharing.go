@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+// The code sharing simulation compares, for every chunker, the code witness of a block when code
+// chunks are keyed by account address versus keyed by code hash. In both cases the witness is
+// shared by all the transactions of the block, so repeated executions of the same bytecode at
+// different addresses only pay once for each code chunk when keyed by code hash.
+//
+// Code-hash stems can't share the account header stem, so besides EIP-6800 the code-hash layout
+// is also compared with address-keyed separate stems, which isolates the effect of sharing.
+var codeSharingLayouts = []analysis.CodeKeyLayout{analysis.DefaultCodeKeyLayout, analysis.NewSeparateStemsLayout(), analysis.NewCodeHashLayout()}
+
+type blockTraces struct {
+	number uint64
+	paths  []string
+}
+
+type codeSharingResult struct {
+	err error
+	// index is the position of the block in the input.
+	index int
+
+	block            uint64
+	numTxs           int
+	numExecContracts int
+	numUniqueCodes   int
+	txScopeMetrics   []analysis.ChunkerMetrics
+	blockMetrics     []analysis.ChunkerMetrics
+}
+
+// loadTxBlocks loads a CSV file with (tx, block_number) lines, and groups the traces by block.
+// Traces without a known block are skipped.
+func loadTxBlocks(txBlocksPath string, pcTracePaths []string) ([]blockTraces, error) {
+	f, err := os.Open(txBlocksPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file %s: %w", txBlocksPath, err)
+	}
+	defer f.Close()
+
+	txBlocks := map[string]uint64{}
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	for i := 0; ; i++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read csv line: %s", err)
+		}
+		blockNumber, err := strconv.ParseUint(strings.TrimSpace(record[1]), 10, 64)
+		if err != nil {
+			if i == 0 {
+				continue // Header.
+			}
+			return nil, fmt.Errorf("invalid block number %s: %s", record[1], err)
+		}
+		txBlocks[strings.ToLower(strings.TrimSpace(record[0]))] = blockNumber
+	}
+
+	blocks := map[uint64]*blockTraces{}
+	for _, pcTracePath := range pcTracePaths {
+		_, txHash := path.Split(pcTracePath)
+		blockNumber, ok := txBlocks[strings.ToLower(txHash)]
+		if !ok {
+			continue
+		}
+		if blocks[blockNumber] == nil {
+			blocks[blockNumber] = &blockTraces{number: blockNumber}
+		}
+		blocks[blockNumber].paths = append(blocks[blockNumber].paths, pcTracePath)
+	}
+	sortedBlocks := make([]blockTraces, 0, len(blocks))
+	for _, block := range blocks {
+		sortedBlocks = append(sortedBlocks, *block)
+	}
+	sort.Slice(sortedBlocks, func(i, j int) bool { return sortedBlocks[i].number < sortedBlocks[j].number })
+
+	return sortedBlocks, nil
+}
+
+func runCodeSharing(ctx context.Context, txBlocksPath string, pcTracePaths []string, contractBytecodes map[common.Address][]byte, out outputFiles) error {
+	blocks, err := loadTxBlocks(txBlocksPath, pcTracePaths)
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		return fmt.Errorf("no traces found for the blocks in %s", txBlocksPath)
+	}
+
+	queue := pipeline.QueueInOrder(blocks)
+	results := make(chan codeSharingResult)
+	for i := 0; i < min(runtime.NumCPU(), len(blocks)); i++ {
+		go processBlocks(ctx, contractBytecodes, queue, results)
+	}
+
+	return genCodeSharingTable(ctx, results, len(blocks), pipeline.ChunkerNames(codeSharingLayouts, false), out)
+}
+
+func processBlocks(ctx context.Context, contractBytecodes map[common.Address][]byte, blocks <-chan pipeline.Indexed[blockTraces], results chan<- codeSharingResult) {
+	chunkers := pipeline.NewChunkers(codeSharingLayouts, false)
+	// out sends the result, unless the run was canceled and it won't be received.
+	out := func(res codeSharingResult) {
+		select {
+		case results <- res:
+		case <-ctx.Done():
+		}
+	}
+
+	for queued := range blocks {
+		if ctx.Err() != nil {
+			return
+		}
+		block := queued.Item
+		res := codeSharingResult{
+			index:          queued.Index,
+			block:          block.number,
+			numTxs:         len(block.paths),
+			txScopeMetrics: make([]analysis.ChunkerMetrics, len(chunkers)),
+		}
+
+		// The block execution is simulated as a single execution of all the PCs of its txs,
+		// since code chunks are only charged the first time they're accessed.
+		blockContractsPCs := map[common.Address][]uint64{}
+		for _, pcTracePath := range block.paths {
+			txOutput, err := pipeline.ReadTrace(pcTracePath)
+			if err != nil {
+				out(codeSharingResult{err: err})
+				return
+			}
+			txMetrics, err := pipeline.RunChunkers(chunkers, txOutput.ContractsPCs, contractBytecodes, false)
+			if err != nil {
+				out(codeSharingResult{err: err})
+				return
+			}
+			for i, cm := range txMetrics {
+				res.txScopeMetrics[i].ChunkerName = cm.ChunkerName
+				res.txScopeMetrics[i].Gas += cm.Gas
+				res.txScopeMetrics[i].BranchGas += cm.BranchGas
+			}
+			for contractAddr, pcs := range txOutput.ContractsPCs {
+				blockContractsPCs[contractAddr] = append(blockContractsPCs[contractAddr], pcs...)
+			}
+		}
+
+		var err error
+		res.blockMetrics, err = pipeline.RunChunkers(chunkers, blockContractsPCs, contractBytecodes, false)
+		if err != nil {
+			out(codeSharingResult{err: err})
+			return
+		}
+
+		uniqueCodes := map[common.Hash]struct{}{}
+		for contractAddr := range blockContractsPCs {
+			uniqueCodes[crypto.Keccak256Hash(contractBytecodes[contractAddr])] = struct{}{}
+		}
+		res.numExecContracts = len(blockContractsPCs)
+		res.numUniqueCodes = len(uniqueCodes)
+
+		out(res)
+	}
+}
+
+func genCodeSharingTable(ctx context.Context, results chan codeSharingResult, expTotalResults int, chunkerNames []string, out outputFiles) (err error) {
+	columns := []column{
+		{name: "block", kind: columnUint},
+		{name: "num_txs", kind: columnInt},
+		{name: "num_exec_contracts", kind: columnInt},
+		{name: "num_unique_codes", kind: columnInt},
+	}
+	for _, cn := range chunkerNames {
+		columns = append(columns,
+			column{name: fmt.Sprintf("%s_tx_scope_gas", cn), kind: columnUint},
+			column{name: fmt.Sprintf("%s_block_scope_gas", cn), kind: columnUint},
+			column{name: fmt.Sprintf("%s_block_scope_witness_bytes", cn), kind: columnUint})
+	}
+	codeSharingTable, err := out.createTable("code_sharing", columns)
+	if err != nil {
+		return err
+	}
+	defer closeTable(codeSharingTable, &err)
+
+	totalGas := make([]uint64, len(chunkerNames))
+	totalWitnessBytes := make([]uint64, len(chunkerNames))
+	// Blocks are written in ascending order, regardless of the order they're processed in.
+	var ordered pipeline.ReorderBuffer[codeSharingResult]
+	emit := func(result codeSharingResult) error {
+		row := []any{result.block, result.numTxs, result.numExecContracts, result.numUniqueCodes}
+		for i, cm := range result.blockMetrics {
+			row = append(row, result.txScopeMetrics[i].Gas, cm.Gas, cm.WitnessSizeBytes())
+			totalGas[i] += cm.Gas
+			totalWitnessBytes[i] += cm.WitnessSizeBytes()
+		}
+		return codeSharingTable.Write(row)
+	}
+	for i := 0; i < expTotalResults; i++ {
+		var result codeSharingResult
+		select {
+		case result = <-results:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if result.err != nil {
+			return fmt.Errorf("error processing: %s", result.err)
+		}
+		if err := ordered.Push(result.index, result, emit); err != nil {
+			return err
+		}
+	}
+
+	// Chunkers are created for every layout in order, so the i-th chunker of each address-keyed
+	// layout corresponds to the i-th chunker of the code-hash-keyed layout, which is the last one.
+	numChunkers := len(chunkerNames) / len(codeSharingLayouts)
+	codeHashOffset := (len(codeSharingLayouts) - 1) * numChunkers
+	for i := 0; i < codeHashOffset; i++ {
+		codeHashIdx := codeHashOffset + i%numChunkers
+		gasSaved := int64(totalGas[i]) - int64(totalGas[codeHashIdx])
+		witnessBytesSaved := int64(totalWitnessBytes[i]) - int64(totalWitnessBytes[codeHashIdx])
+		fmt.Printf("%s vs %s: saves %d gas (%.2f%%) and %d witness bytes (%.2f%%)\n",
+			chunkerNames[codeHashIdx], chunkerNames[i],
+			gasSaved, percentage(gasSaved, totalGas[i]),
+			witnessBytesSaved, percentage(witnessBytesSaved, totalWitnessBytes[i]))
+	}
+
+	return nil
+}
+
+func percentage(part int64, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) * 100 / float64(total)
+}
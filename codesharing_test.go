@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+func TestRunCodeSharing(t *testing.T) {
+	pcTracePaths, contractBytecodes, err := pipeline.LoadData("testdata/traces", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Traces of txs without a block are skipped.
+	txBlocks := "tx,block_number\n" +
+		"0x000000000000000000000000000000000000000000000000000000000007a000,100\n" +
+		"0x000000000000000000000000000000000000000000000000000000000007a001,100\n" +
+		"0x000000000000000000000000000000000000000000000000000000000007a002,101\n" +
+		"0x000000000000000000000000000000000000000000000000000000000007a003,101\n" +
+		"0x000000000000000000000000000000000000000000000000000000000007a004,101\n" +
+		"0x000000000000000000000000000000000000000000000000000000000007a007,102\n"
+	txBlocksPath := filepath.Join(t.TempDir(), "tx_blocks.csv")
+	if err := os.WriteFile(txBlocksPath, []byte(txBlocks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := outputFiles{dir: t.TempDir(), format: formatCSV}
+	if err := runCodeSharing(context.Background(), txBlocksPath, pcTracePaths, contractBytecodes, out); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(out.path("code_sharing.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunkerNames := pipeline.ChunkerNames(codeSharingLayouts, false)
+	if len(rows) != 4 || len(rows[0]) != 4+3*len(chunkerNames) {
+		t.Fatalf("expected a header and 3 blocks of %d columns, got %d rows of %d columns", 4+3*len(chunkerNames), len(rows), len(rows[0]))
+	}
+	gas := func(row []string, column int) uint64 {
+		v, err := strconv.ParseUint(row[column], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	expectedBlocks := [][2]string{{"100", "2"}, {"101", "3"}, {"102", "1"}}
+	numChunkers := len(chunkerNames) / len(codeSharingLayouts)
+	for i, row := range rows[1:] {
+		if row[0] != expectedBlocks[i][0] || row[1] != expectedBlocks[i][1] {
+			t.Fatalf("expected block %s with %s txs, got block %s with %s txs", expectedBlocks[i][0], expectedBlocks[i][1], row[0], row[1])
+		}
+		for j, cn := range chunkerNames {
+			txScopeGas, blockScopeGas := gas(row, 4+3*j), gas(row, 5+3*j)
+			// Chunks touched by several txs of the block are only charged once.
+			if blockScopeGas > txScopeGas || (row[1] == "1" && blockScopeGas != txScopeGas) {
+				t.Fatalf("block %s: %s charged %d gas in the block, and %d in its txs", row[0], cn, blockScopeGas, txScopeGas)
+			}
+			// Keying code by hash can only share chunks compared to separate stems.
+			if j >= numChunkers && j < 2*numChunkers {
+				codeHashGas := gas(row, 5+3*(j+numChunkers))
+				if codeHashGas > blockScopeGas {
+					t.Fatalf("block %s: %s charged %d gas, more than the %d of %s", row[0], chunkerNames[j+numChunkers], codeHashGas, blockScopeGas, cn)
+				}
+			}
+		}
+	}
+	// Both txs of block 100 execute the same contracts.
+	if txScopeGas, blockScopeGas := gas(rows[1], 4), gas(rows[1], 5); blockScopeGas >= txScopeGas {
+		t.Fatalf("expected block 100 to charge less gas than its txs, got %d and %d", blockScopeGas, txScopeGas)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+// compareTopN is the number of txs, contracts and chunks with the largest differences printed.
+const compareTopN = 10
+
+// compareDeltaBounds are the upper bounds of the histogram buckets of the per-tx gas difference
+// between the compared chunkers.
+var compareDeltaBounds = []int64{-5000, -1000, -200, -1, 0, 200, 1000, 5000}
+
+type comparisonReport struct {
+	A          string `json:"a"`
+	B          string `json:"b"`
+	NumTxs     int    `json:"num_txs"`
+	ReceiptGas uint64 `json:"receipt_gas"`
+	GasA       uint64 `json:"gas_a"`
+	GasB       uint64 `json:"gas_b"`
+	// Delta is the gas of B minus the gas of A, so it's negative if B is cheaper.
+	Delta    int64   `json:"delta"`
+	DeltaPct float64 `json:"delta_pct"`
+	// TxsBCheaper, TxsEqual and TxsBMoreExpensive count the txs by the sign of their delta.
+	TxsBCheaper       int `json:"txs_b_cheaper"`
+	TxsEqual          int `json:"txs_equal"`
+	TxsBMoreExpensive int `json:"txs_b_more_expensive"`
+	// FlippedTxs is the number of txs where the cheaper chunker isn't the cheaper one in total.
+	FlippedTxs       int               `json:"flipped_txs"`
+	TxAbsDelta       quantiles         `json:"tx_abs_delta"`
+	TxDeltaHistogram []histogramBucket `json:"tx_delta_histogram"`
+
+	txAbsDeltaSketch  quantileSketch
+	txDeltaHistCounts []uint64
+	// largestDeltas are the txs with the largest negative and positive deltas.
+	largestDeltas [2][]txDelta
+}
+
+type txDelta struct {
+	tx    string
+	to    common.Address
+	delta int64
+}
+
+// gasPair is the code access gas of the A and B chunkers.
+type gasPair [2]uint64
+
+func (g gasPair) delta() int64 {
+	return int64(g[1]) - int64(g[0])
+}
+
+// runCompare runs two chunkers over the traces, and reports where and by how much their code
+// access gas differs.
+func runCompare(args []string) error {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	pcTraceFolderFlag := flags.String("tracespath", "", "Full path of the folder containing the traces")
+	aFlag := flags.String("a", "31bytechunker", "Name of the first chunker to compare")
+	bFlag := flags.String("b", "32bytechunker", "Name of the second chunker to compare")
+	codeLayoutsFlag := flags.String("code-layouts", "eip6800", "Comma separated list of code key layouts to run every chunker under (eip6800, separatestems, codehash, header<N>).")
+	bitmapChunkersFlag := flags.Bool("bitmap-chunkers", false, bitmapChunkersUsage)
+	outFlag := flags.String("out", ".", "Folder where the generated files are written")
+	runIDFlag := flags.String("run-id", "", "Prefix for the names of the generated files, to keep the results of different runs apart")
+	formatFlag := flags.String("format", formatCSV, fmt.Sprintf("Format of the generated tables (%s)", strings.Join(tableFormats, "|")))
+	maxMemoryFlag := flags.String("max-memory", "", "Memory budget of the comparison (e.g: 12GB), bounding the traces in flight and spilling the chunks to disk. Unbounded if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *pcTraceFolderFlag == "" {
+		return fmt.Errorf("expected --tracespath <folder> flag")
+	}
+	layouts, err := parseCodeKeyLayouts(*codeLayoutsFlag)
+	if err != nil {
+		return err
+	}
+	names := pipeline.ChunkerNames(layouts, *bitmapChunkersFlag)
+	a, b := slices.Index(names, *aFlag), slices.Index(names, *bFlag)
+	if a == -1 || b == -1 {
+		return fmt.Errorf("unknown chunker, expected one of %s", strings.Join(names, ", "))
+	}
+	if !slices.Contains(tableFormats, *formatFlag) {
+		return fmt.Errorf("unsupported output format %s", *formatFlag)
+	}
+	var maxMemory int64
+	if *maxMemoryFlag != "" {
+		if maxMemory, err = parseByteSize(*maxMemoryFlag); err != nil {
+			return err
+		}
+		debug.SetMemoryLimit(maxMemory)
+	}
+	out := outputFiles{dir: *outFlag, runID: *runIDFlag, format: *formatFlag}
+	if err := os.MkdirAll(out.dir, 0755); err != nil {
+		return fmt.Errorf("could not create output folder: %s", err)
+	}
+
+	pcTracePaths, contractBytecodes, err := loadData(*pcTraceFolderFlag, -1)
+	if err != nil {
+		return err
+	}
+	progress := newProgressTracker(len(pcTracePaths), runtime.NumCPU(), defaultProgressInterval)
+	err = runWithProgress(interruptibleContext(), pipeline.Options{
+		TracePaths:        pcTracePaths,
+		ContractBytecodes: contractBytecodes,
+		Chunkers:          func() []analysis.Chunker { return pipeline.NewChunkers(layouts, *bitmapChunkersFlag) },
+		AllChunksStats:    true,
+		MaxInFlightBytes:  splitMemory(maxMemory, 2),
+		Sinks: []pipeline.Sink{func(results <-chan pipeline.Result) error {
+			return genComparison(results, names[a], names[b], a, b, splitMemory(maxMemory, 2), out)
+		}},
+	}, progress)
+	if errors.Is(err, context.Canceled) {
+		return errInterrupted
+	}
+	return err
+}
+
+// genComparison consumes the results, writing the per-tx differences between the chunkers at
+// indexes a and b, and aggregating them by contract and chunk. The chunks are aggregated and then
+// ranked by abs delta within chunksMemory, or spilled to disk, unless it's 0.
+func genComparison(results <-chan pipeline.Result, nameA, nameB string, a, b int, chunksMemory int64, out outputFiles) (err error) {
+	columns := []column{
+		{name: "tx", kind: columnHash},
+		{name: "to", kind: columnAddress},
+		{name: "receipt_gas", kind: columnUint},
+		{name: "a_gas", kind: columnUint},
+		{name: "b_gas", kind: columnUint},
+		{name: "delta", kind: columnInt},
+		{name: "cheaper", kind: columnString},
+	}
+	txsTable, err := out.createTable("compare_txs", columns)
+	if err != nil {
+		return err
+	}
+	defer closeTable(txsTable, &err)
+
+	report := comparisonReport{A: nameA, B: nameB, txDeltaHistCounts: make([]uint64, len(compareDeltaBounds)+1)}
+	contracts := map[common.Address]*gasPair{}
+	// Both steps keep their entries in memory while the chunks are ranked.
+	stepMemory := splitMemory(chunksMemory, 2)
+	chunkBytes := func(gasPair) int64 { return chunkGasBytes }
+	chunks := newSpillSorter(out.dir, stepMemory, compareChunkKeys, chunkBytes, func(a, b gasPair) gasPair {
+		return gasPair{a[0] + b[0], a[1] + b[1]}
+	})
+	// Chunks are ranked once, so their gas is never combined.
+	chunksRanking := newSpillSorter(out.dir, stepMemory, compareChunkRanks, chunkBytes, func(a, _ gasPair) gasPair { return a })
+	defer closeSpillSorter(chunks, &err)
+	defer closeSpillSorter(chunksRanking, &err)
+	for result := range results {
+		cmA, cmB := result.ChunkersMetrics[a], result.ChunkersMetrics[b]
+		tx := gasPair{cmA.Gas, cmB.Gas}
+		report.NumTxs++
+		report.ReceiptGas += result.ReceiptGas
+		report.GasA += tx[0]
+		report.GasB += tx[1]
+		delta := tx.delta()
+		report.txAbsDeltaSketch.add(float64(max(delta, -delta)))
+		report.txDeltaHistCounts[sort.Search(len(compareDeltaBounds), func(i int) bool { return delta <= compareDeltaBounds[i] })]++
+		cheaper := ""
+		switch {
+		case delta < 0:
+			report.TxsBCheaper++
+			report.largestDeltas[0] = insertLargestDelta(report.largestDeltas[0], txDelta{tx: result.Tx, to: result.To, delta: delta})
+			cheaper = nameB
+		case delta > 0:
+			report.TxsBMoreExpensive++
+			report.largestDeltas[1] = insertLargestDelta(report.largestDeltas[1], txDelta{tx: result.Tx, to: result.To, delta: delta})
+			cheaper = nameA
+		default:
+			report.TxsEqual++
+		}
+
+		for side, cm := range []int{a, b} {
+			for addr, stats := range result.ChunkersMetrics[cm].ContractsStats {
+				if contracts[addr] == nil {
+					contracts[addr] = &gasPair{}
+				}
+				contracts[addr][side] += stats.Gas
+				for _, chunkStats := range stats.ChunksStats {
+					var gas gasPair
+					gas[side] = chunkStats.ChargedGas
+					if err := chunks.add(chunkKey{Addr: addr, ChunkNumber: chunkStats.ChunkNumber}, gas); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if delta == 0 {
+			continue
+		}
+		if err := txsTable.Write([]any{common.HexToHash(result.Tx), result.To, result.ReceiptGas, tx[0], tx[1], int(delta), cheaper}); err != nil {
+			return err
+		}
+	}
+
+	report.Delta = int64(report.GasB) - int64(report.GasA)
+	report.DeltaPct = percentage(report.Delta, report.GasA)
+	switch {
+	case report.Delta < 0:
+		report.FlippedTxs = report.TxsBMoreExpensive
+	case report.Delta > 0:
+		report.FlippedTxs = report.TxsBCheaper
+	}
+	report.TxAbsDelta = report.txAbsDeltaSketch.quantiles()
+	for i, count := range report.txDeltaHistCounts {
+		upperBound := "+Inf"
+		if i < len(compareDeltaBounds) {
+			upperBound = fmt.Sprint(compareDeltaBounds[i])
+		}
+		report.TxDeltaHistogram = append(report.TxDeltaHistogram, histogramBucket{UpperBound: upperBound, Count: count})
+	}
+
+	contractsRanking := pipeline.SortedAddresses(contracts)
+	sort.SliceStable(contractsRanking, func(i, j int) bool {
+		return absDelta(*contracts[contractsRanking[i]]) > absDelta(*contracts[contractsRanking[j]])
+	})
+	if err := genCompareContractsTable(contractsRanking, contracts, out); err != nil {
+		return err
+	}
+	err = chunks.each(func(chunk chunkKey, gas gasPair) error {
+		return chunksRanking.add(chunkRank{AbsDelta: absDelta(gas), Chunk: chunk}, gas)
+	})
+	if err != nil {
+		return err
+	}
+	chunksTable, err := out.createTable("compare_chunks", []column{
+		{name: "contract_addr", kind: columnAddress},
+		{name: "chunk_number", kind: columnInt},
+		{name: "a_gas", kind: columnUint},
+		{name: "b_gas", kind: columnUint},
+		{name: "delta", kind: columnInt},
+	})
+	if err != nil {
+		return err
+	}
+	defer closeTable(chunksTable, &err)
+	var topChunks strings.Builder
+	var numTopChunks int
+	err = chunksRanking.each(func(rank chunkRank, gas gasPair) error {
+		chunk := rank.Chunk
+		if err := chunksTable.Write([]any{chunk.Addr, chunk.ChunkNumber, gas[0], gas[1], int(gas.delta())}); err != nil {
+			return err
+		}
+		if numTopChunks < compareTopN {
+			numTopChunks++
+			fmt.Fprintf(&topChunks, "  %s chunk %d: A %d, B %d, delta %+d\n", chunk.Addr.Hex(), chunk.ChunkNumber, gas[0], gas[1], gas.delta())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode comparison: %s", err)
+	}
+	if err := os.WriteFile(out.path("compare.json"), append(encoded, '\n'), 0644); err != nil {
+		return fmt.Errorf("could not write comparison: %s", err)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s (A) vs %s (B) over %d txs:\n", nameA, nameB, report.NumTxs)
+	fmt.Fprintf(&sb, "  Gas: A %d, B %d, delta %+d (%+.2f%%)\n", report.GasA, report.GasB, report.Delta, report.DeltaPct)
+	fmt.Fprintf(&sb, "  Txs: %d B cheaper, %d equal, %d B more expensive, %d flipped\n", report.TxsBCheaper, report.TxsEqual, report.TxsBMoreExpensive, report.FlippedTxs)
+	fmt.Fprintf(&sb, "  Tx abs delta: p50 %.0f, p90 %.0f, p99 %.0f\n", report.TxAbsDelta.P50, report.TxAbsDelta.P90, report.TxAbsDelta.P99)
+	fmt.Fprintf(&sb, "Top contracts by abs delta:\n")
+	for _, addr := range contractsRanking[:min(compareTopN, len(contractsRanking))] {
+		gas := contracts[addr]
+		fmt.Fprintf(&sb, "  %s: A %d, B %d, delta %+d\n", addr.Hex(), gas[0], gas[1], gas.delta())
+	}
+	fmt.Fprintf(&sb, "Top chunks by abs delta:\n%s", topChunks.String())
+	if report.FlippedTxs > 0 {
+		flipped := report.largestDeltas[1]
+		if report.Delta > 0 {
+			flipped = report.largestDeltas[0]
+		}
+		fmt.Fprintf(&sb, "Top flipped txs:\n")
+		for _, td := range flipped {
+			fmt.Fprintf(&sb, "  %s (to %s): delta %+d\n", td.tx, td.to.Hex(), td.delta)
+		}
+	}
+	fmt.Print(sb.String())
+	return nil
+}
+
+// chunkKey is a chunk of a contract. Chunk numbers refer to the chunked code of each chunker, so
+// if A and B chunk the code differently, the same chunk number can cover different code in both.
+type chunkKey struct {
+	Addr        common.Address
+	ChunkNumber int
+}
+
+func compareChunkKeys(a, b chunkKey) int {
+	if c := compareAddresses(a.Addr, b.Addr); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.ChunkNumber, b.ChunkNumber)
+}
+
+// chunkRank orders the chunks by descending abs delta, and then by contract and chunk number.
+type chunkRank struct {
+	AbsDelta int64
+	Chunk    chunkKey
+}
+
+func compareChunkRanks(a, b chunkRank) int {
+	if a.AbsDelta != b.AbsDelta {
+		return cmp.Compare(b.AbsDelta, a.AbsDelta)
+	}
+	return compareChunkKeys(a.Chunk, b.Chunk)
+}
+
+// chunkGasBytes estimates the memory of the gas of a chunk, including its key and the map
+// overhead.
+const chunkGasBytes = 80
+
+func absDelta(gas gasPair) int64 {
+	delta := gas.delta()
+	return max(delta, -delta)
+}
+
+// insertLargestDelta keeps the compareTopN txs with the largest abs delta, in descending order.
+func insertLargestDelta(largest []txDelta, td txDelta) []txDelta {
+	i := sort.Search(len(largest), func(i int) bool {
+		return max(largest[i].delta, -largest[i].delta) < max(td.delta, -td.delta)
+	})
+	if i >= compareTopN {
+		return largest
+	}
+	largest = slices.Insert(largest, i, td)
+	return largest[:min(len(largest), compareTopN)]
+}
+
+func genCompareContractsTable(ranking []common.Address, contracts map[common.Address]*gasPair, out outputFiles) (err error) {
+	contractsTable, err := out.createTable("compare_contracts", []column{
+		{name: "contract_addr", kind: columnAddress},
+		{name: "a_gas", kind: columnUint},
+		{name: "b_gas", kind: columnUint},
+		{name: "delta", kind: columnInt},
+	})
+	if err != nil {
+		return err
+	}
+	defer closeTable(contractsTable, &err)
+	for _, addr := range ranking {
+		gas := contracts[addr]
+		if err := contractsTable.Write([]any{addr, gas[0], gas[1], int(gas.delta())}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
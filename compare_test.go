@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+func TestGenComparison(t *testing.T) {
+	pcTracePaths, contractBytecodes, err := pipeline.LoadData("testdata/traces", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []pipeline.Result
+	runner := pipeline.NewRunner(pipeline.Options{
+		TracePaths:        pcTracePaths,
+		ContractBytecodes: contractBytecodes,
+		AllChunksStats:    true,
+		Sinks: []pipeline.Sink{func(rs <-chan pipeline.Result) error {
+			for result := range rs {
+				results = append(results, result)
+			}
+			return nil
+		}},
+	})
+	if err := runner.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	names := runner.ChunkerNames()
+	if names[0] != "31bytechunker" || names[1] != "32bytechunker" {
+		t.Fatalf("unexpected chunkers %v", names)
+	}
+	// The 31-byte chunker is cheaper in all the traces, so a tx where the 32-byte chunker is
+	// 2000 gas cheaper is flipped.
+	results = append(results, pipeline.Result{
+		Tx:              "0x00000000000000000000000000000000000000000000000000000000000000ff",
+		ChunkersMetrics: []analysis.ChunkerMetrics{{Gas: 3000}, {Gas: 1000}, {}},
+	})
+
+	// The chunks spill to disk within the smaller memory budget.
+	for _, chunksMemory := range []int64{0, 1 << 10} {
+		t.Run(fmt.Sprintf("chunks-memory=%d", chunksMemory), func(t *testing.T) {
+			testGenComparison(t, results, names, chunksMemory)
+		})
+	}
+}
+
+func testGenComparison(t *testing.T, results []pipeline.Result, names []string, chunksMemory int64) {
+	resultsCh := make(chan pipeline.Result, len(results))
+	for _, result := range results {
+		resultsCh <- result
+	}
+	close(resultsCh)
+	out := outputFiles{dir: t.TempDir(), format: formatCSV}
+	if err := genComparison(resultsCh, names[0], names[1], 0, 1, chunksMemory, out); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(out.path("compare.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report comparisonReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.NumTxs != 11 || report.GasA != 79900 || report.GasB != 83500 || report.Delta != 3600 {
+		t.Fatalf("expected 11 txs with 79900 and 83500 gas, got %d txs with %d and %d gas, delta %d",
+			report.NumTxs, report.GasA, report.GasB, report.Delta)
+	}
+	if report.TxsBCheaper != 1 || report.TxsEqual != 0 || report.TxsBMoreExpensive != 10 || report.FlippedTxs != 1 {
+		t.Fatalf("expected 1 B cheaper, 0 equal, 10 B more expensive and 1 flipped txs, got %d, %d, %d and %d",
+			report.TxsBCheaper, report.TxsEqual, report.TxsBMoreExpensive, report.FlippedTxs)
+	}
+	expectedHistogram := []uint64{0, 1, 0, 0, 0, 3, 6, 1, 0}
+	if len(report.TxDeltaHistogram) != len(expectedHistogram) {
+		t.Fatalf("expected %d histogram buckets, got %d", len(expectedHistogram), len(report.TxDeltaHistogram))
+	}
+	for i, bucket := range report.TxDeltaHistogram {
+		if bucket.Count != expectedHistogram[i] {
+			t.Fatalf("expected %d txs in the bucket up to %s, got %d", expectedHistogram[i], bucket.UpperBound, bucket.Count)
+		}
+	}
+
+	// The chunks add up to the gas of each chunker in the traces, ranked by descending abs delta.
+	f, err := os.Open(filepath.Join(out.dir, "compare_chunks.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func(v string) int64 {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	var gasA, gasB int64
+	prevAbsDelta := int64(math.MaxInt64)
+	for _, row := range rows[1:] {
+		a, b, delta := parse(row[2]), parse(row[3]), parse(row[4])
+		if delta != b-a || max(delta, -delta) > prevAbsDelta {
+			t.Fatalf("chunk %s of %s: delta %d of %d and %d gas, ranked after an abs delta of %d", row[1], row[0], delta, a, b, prevAbsDelta)
+		}
+		prevAbsDelta = max(delta, -delta)
+		gasA += a
+		gasB += b
+	}
+	if gasA != 76900 || gasB != 82500 {
+		t.Fatalf("expected chunks gas of 76900 and 82500, got %d and %d", gasA, gasB)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type runsDiffReport struct {
+	BaseGethVersion string `json:"base_geth_version"`
+	NewGethVersion  string `json:"new_geth_version"`
+	// OnlyInBase and OnlyInNew are the number of txs that are in a single run.
+	OnlyInBase       int               `json:"only_in_base"`
+	OnlyInNew        int               `json:"only_in_new"`
+	ChangedTxs       int               `json:"changed_txs"`
+	ChangedContracts int               `json:"changed_contracts"`
+	Chunkers         []chunkerRunsDiff `json:"chunkers"`
+	MissingChunkers  []string          `json:"missing_chunkers,omitempty"`
+	ThresholdPct     float64           `json:"threshold_pct"`
+	Passed           bool              `json:"passed"`
+	Failures         []string          `json:"failures,omitempty"`
+
+	largestDeltas []txDelta
+}
+
+type chunkerRunsDiff struct {
+	Name         string  `json:"name"`
+	BaseGas      uint64  `json:"base_gas"`
+	NewGas       uint64  `json:"new_gas"`
+	GasDeltaPct  float64 `json:"gas_delta_pct"`
+	BaseSize     uint64  `json:"base_chunked_size"`
+	NewSize      uint64  `json:"new_chunked_size"`
+	SizeDeltaPct float64 `json:"size_delta_pct"`
+}
+
+// runDiffRuns joins the results of two runs by tx and contract, and checks that the gas and
+// chunked sizes of every chunker didn't change more than a threshold.
+func runDiffRuns(args []string) error {
+	flags := flag.NewFlagSet("diffruns", flag.ExitOnError)
+	baseFlag := flags.String("base", "", "Folder with the files of the base run, written with --format csv or jsonl")
+	baseRunIDFlag := flags.String("base-run-id", "", "Run id of the base run")
+	newFlag := flags.String("new", "", "Folder with the files of the new run, written with --format csv or jsonl")
+	newRunIDFlag := flags.String("new-run-id", "", "Run id of the new run")
+	thresholdFlag := flags.Float64("threshold", 0, "Maximum change of the total gas and chunked size of every chunker, as a percentage, for the check to pass")
+	outFlag := flags.String("out", ".", "Folder where the generated files are written")
+	runIDFlag := flags.String("run-id", "", "Prefix for the names of the generated files, to keep the results of different runs apart")
+	formatFlag := flags.String("format", formatCSV, fmt.Sprintf("Format of the generated tables (%s)", strings.Join(tableFormats, "|")))
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *baseFlag == "" || *newFlag == "" {
+		return fmt.Errorf("expected --base <folder> and --new <folder> flags")
+	}
+	if !slices.Contains(tableFormats, *formatFlag) {
+		return fmt.Errorf("unsupported output format %s", *formatFlag)
+	}
+	out := outputFiles{dir: *outFlag, runID: *runIDFlag, format: *formatFlag}
+	if err := os.MkdirAll(out.dir, 0755); err != nil {
+		return fmt.Errorf("could not create output folder: %s", err)
+	}
+
+	baseOut, baseManifest, err := openRun(*baseFlag, *baseRunIDFlag)
+	if err != nil {
+		return fmt.Errorf("base run: %s", err)
+	}
+	newOut, newManifest, err := openRun(*newFlag, *newRunIDFlag)
+	if err != nil {
+		return fmt.Errorf("new run: %s", err)
+	}
+
+	report := runsDiffReport{
+		BaseGethVersion: baseManifest.GethVersion,
+		NewGethVersion:  newManifest.GethVersion,
+		ThresholdPct:    *thresholdFlag,
+	}
+	var chunkers []string
+	for _, name := range newManifest.Chunkers {
+		if slices.Contains(baseManifest.Chunkers, name) {
+			chunkers = append(chunkers, name)
+		}
+	}
+	for _, name := range append(slices.Clone(baseManifest.Chunkers), newManifest.Chunkers...) {
+		if !slices.Contains(chunkers, name) && !slices.Contains(report.MissingChunkers, name) {
+			report.MissingChunkers = append(report.MissingChunkers, name)
+		}
+	}
+	report.Chunkers = make([]chunkerRunsDiff, len(chunkers))
+	for i, name := range chunkers {
+		report.Chunkers[i].Name = name
+	}
+
+	if err := diffGasTables(&report, chunkers, baseOut, newOut, out); err != nil {
+		return err
+	}
+	if err := diffChunkedSizesTables(&report, chunkers, baseOut, newOut, out); err != nil {
+		return err
+	}
+
+	if report.OnlyInBase > 0 || report.OnlyInNew > 0 {
+		report.Failures = append(report.Failures, fmt.Sprintf("%d txs are only in the base run and %d only in the new run", report.OnlyInBase, report.OnlyInNew))
+	}
+	if len(report.MissingChunkers) > 0 {
+		report.Failures = append(report.Failures, fmt.Sprintf("chunkers %s aren't in both runs", strings.Join(report.MissingChunkers, ", ")))
+	}
+	for i := range report.Chunkers {
+		cd := &report.Chunkers[i]
+		cd.GasDeltaPct = percentage(int64(cd.NewGas)-int64(cd.BaseGas), cd.BaseGas)
+		cd.SizeDeltaPct = percentage(int64(cd.NewSize)-int64(cd.BaseSize), cd.BaseSize)
+		if math.Abs(cd.GasDeltaPct) > report.ThresholdPct {
+			report.Failures = append(report.Failures, fmt.Sprintf("%s gas changed %+.4f%%", cd.Name, cd.GasDeltaPct))
+		}
+		if math.Abs(cd.SizeDeltaPct) > report.ThresholdPct {
+			report.Failures = append(report.Failures, fmt.Sprintf("%s chunked size changed %+.4f%%", cd.Name, cd.SizeDeltaPct))
+		}
+	}
+	report.Passed = len(report.Failures) == 0
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode runs diff: %s", err)
+	}
+	if err := os.WriteFile(out.path("diffruns.json"), append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("could not write runs diff: %s", err)
+	}
+	fmt.Print(report.text())
+	if !report.Passed {
+		return fmt.Errorf("runs differ more than the %g%% threshold", report.ThresholdPct)
+	}
+	return nil
+}
+
+// openRun resolves the files of a previous run from its manifest.
+func openRun(dir, runID string) (outputFiles, *runManifest, error) {
+	out := outputFiles{dir: dir, runID: runID}
+	manifest, err := readRunManifest(out)
+	if err != nil {
+		return outputFiles{}, nil, err
+	}
+	if manifest.Status != runStatusCompleted {
+		return outputFiles{}, nil, fmt.Errorf("run status is %s", manifest.Status)
+	}
+	out.format = manifest.Flags["format"]
+	if !slices.Contains(readableFormats, out.format) {
+		return outputFiles{}, nil, fmt.Errorf("runs with format %s can't be read, only %s", out.format, strings.Join(readableFormats, "|"))
+	}
+	return out, manifest, nil
+}
+
+// diffGasTables joins the gas tables of both runs by tx, and writes the gas of every chunker
+// that changed for a tx.
+func diffGasTables(report *runsDiffReport, chunkers []string, baseOut, newOut, out outputFiles) (err error) {
+	baseTxs := map[string][]uint64{}
+	err = readTableRows(baseOut, "gas_analysis", func(row map[string]string) error {
+		gas, err := parseUintColumns(row, chunkers, "_gas")
+		if err != nil {
+			return err
+		}
+		for i, g := range gas {
+			report.Chunkers[i].BaseGas += g
+		}
+		baseTxs[row["tx"]] = gas
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	txsTable, err := out.createTable("diffruns_txs", []column{
+		{name: "tx", kind: columnHash},
+		{name: "to", kind: columnAddress},
+		{name: "chunker", kind: columnString},
+		{name: "base_gas", kind: columnUint},
+		{name: "new_gas", kind: columnUint},
+		{name: "delta", kind: columnInt},
+	})
+	if err != nil {
+		return err
+	}
+	defer closeTable(txsTable, &err)
+	err = readTableRows(newOut, "gas_analysis", func(row map[string]string) error {
+		gas, err := parseUintColumns(row, chunkers, "_gas")
+		if err != nil {
+			return err
+		}
+		for i, g := range gas {
+			report.Chunkers[i].NewGas += g
+		}
+		base, ok := baseTxs[row["tx"]]
+		if !ok {
+			report.OnlyInNew++
+			return nil
+		}
+		delete(baseTxs, row["tx"])
+
+		var largestDelta int64
+		for i, cn := range chunkers {
+			delta := int64(gas[i]) - int64(base[i])
+			if delta == 0 {
+				continue
+			}
+			if max(delta, -delta) > max(largestDelta, -largestDelta) {
+				largestDelta = delta
+			}
+			tx, to := common.HexToHash(row["tx"]), common.HexToAddress(row["to"])
+			if err := txsTable.Write([]any{tx, to, cn, base[i], gas[i], int(delta)}); err != nil {
+				return err
+			}
+		}
+		if largestDelta != 0 {
+			report.ChangedTxs++
+			report.largestDeltas = insertLargestDelta(report.largestDeltas, txDelta{tx: row["tx"], to: common.HexToAddress(row["to"]), delta: largestDelta})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	report.OnlyInBase = len(baseTxs)
+	return nil
+}
+
+// diffChunkedSizesTables joins the chunked sizes tables of both runs by contract, and writes the
+// chunked size of every chunker that changed for a contract.
+func diffChunkedSizesTables(report *runsDiffReport, chunkers []string, baseOut, newOut, out outputFiles) (err error) {
+	baseSizes := map[common.Address][]uint64{}
+	err = readTableRows(baseOut, "contracts_chunked_sizes", func(row map[string]string) error {
+		sizes, err := parseUintColumns(row, chunkers, "_chunked_size")
+		if err != nil {
+			return err
+		}
+		for i, size := range sizes {
+			report.Chunkers[i].BaseSize += size
+		}
+		baseSizes[common.HexToAddress(row["contract_addr"])] = sizes
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	contractsTable, err := out.createTable("diffruns_contracts", []column{
+		{name: "contract_addr", kind: columnAddress},
+		{name: "chunker", kind: columnString},
+		{name: "base_chunked_size", kind: columnUint},
+		{name: "new_chunked_size", kind: columnUint},
+		{name: "delta", kind: columnInt},
+	})
+	if err != nil {
+		return err
+	}
+	defer closeTable(contractsTable, &err)
+	return readTableRows(newOut, "contracts_chunked_sizes", func(row map[string]string) error {
+		sizes, err := parseUintColumns(row, chunkers, "_chunked_size")
+		if err != nil {
+			return err
+		}
+		for i, size := range sizes {
+			report.Chunkers[i].NewSize += size
+		}
+		addr := common.HexToAddress(row["contract_addr"])
+		base, ok := baseSizes[addr]
+		if !ok {
+			// Runs over different txs are already reported, and touch different contracts.
+			return nil
+		}
+		changed := false
+		for i, cn := range chunkers {
+			if sizes[i] == base[i] {
+				continue
+			}
+			changed = true
+			if err := contractsTable.Write([]any{addr, cn, base[i], sizes[i], int(sizes[i]) - int(base[i])}); err != nil {
+				return err
+			}
+		}
+		if changed {
+			report.ChangedContracts++
+		}
+		return nil
+	})
+}
+
+// readTableRows calls f with every row of a table of a run.
+func readTableRows(run outputFiles, name string, f func(row map[string]string) error) error {
+	table, err := run.openTable(name)
+	if err != nil {
+		return fmt.Errorf("could not open %s table: %s", name, err)
+	}
+	defer table.Close()
+	for {
+		row, err := table.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read %s table: %s", name, err)
+		}
+		if err := f(row); err != nil {
+			return err
+		}
+	}
+}
+
+// parseUintColumns parses the <chunker><suffix> column of every chunker.
+func parseUintColumns(row map[string]string, chunkers []string, suffix string) ([]uint64, error) {
+	values := make([]uint64, len(chunkers))
+	for i, cn := range chunkers {
+		v, ok := row[cn+suffix]
+		if !ok {
+			return nil, fmt.Errorf("missing column %s", cn+suffix)
+		}
+		value, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %s: %s", cn+suffix, v, err)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func (r runsDiffReport) text() string {
+	var sb strings.Builder
+	if r.BaseGethVersion != r.NewGethVersion {
+		fmt.Fprintf(&sb, "go-ethereum changed from %s to %s\n", r.BaseGethVersion, r.NewGethVersion)
+	}
+	fmt.Fprintf(&sb, "%d changed txs, %d changed contracts, %d txs only in base, %d txs only in new\n",
+		r.ChangedTxs, r.ChangedContracts, r.OnlyInBase, r.OnlyInNew)
+	for _, cd := range r.Chunkers {
+		fmt.Fprintf(&sb, "  %s: gas %d -> %d (%+.4f%%), chunked size %d -> %d (%+.4f%%)\n",
+			cd.Name, cd.BaseGas, cd.NewGas, cd.GasDeltaPct, cd.BaseSize, cd.NewSize, cd.SizeDeltaPct)
+	}
+	if len(r.largestDeltas) > 0 {
+		fmt.Fprintf(&sb, "Top changed txs:\n")
+		for _, td := range r.largestDeltas {
+			fmt.Fprintf(&sb, "  %s (to %s): delta %+d\n", td.tx, td.to.Hex(), td.delta)
+		}
+	}
+	if r.Passed {
+		fmt.Fprintf(&sb, "PASS: no chunker changed more than %g%%\n", r.ThresholdPct)
+	} else {
+		fmt.Fprintf(&sb, "FAIL:\n")
+		for _, failure := range r.Failures {
+			fmt.Fprintf(&sb, "  %s\n", failure)
+		}
+	}
+	return sb.String()
+}
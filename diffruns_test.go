@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// writeTestRun writes a completed run with the gas of every tx and the chunked size of a
+// contract for a single chunker.
+func writeTestRun(t *testing.T, format string, txsGas map[uint64]uint64) string {
+	out := outputFiles{dir: t.TempDir(), format: format}
+	manifest := &runManifest{Status: runStatusCompleted, Chunkers: []string{"testchunker"}, Flags: map[string]string{"format": format}}
+	if err := manifest.write(out); err != nil {
+		t.Fatal(err)
+	}
+	if format != formatCSV {
+		return out.dir
+	}
+
+	gasTable, err := out.createTable("gas_analysis", []column{
+		{name: "tx", kind: columnHash},
+		{name: "to", kind: columnAddress},
+		{name: "testchunker_gas", kind: columnUint},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tx := uint64(1); tx <= 4; tx++ {
+		if gas, ok := txsGas[tx]; ok {
+			if err := gasTable.Write([]any{common.Hash{31: byte(tx)}, common.HexToAddress("0xc0de"), gas}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := gasTable.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sizesTable, err := out.createTable("contracts_chunked_sizes", []column{
+		{name: "contract_addr", kind: columnAddress},
+		{name: "testchunker_chunked_size", kind: columnUint},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sizesTable.Write([]any{common.HexToAddress("0xc0de"), uint64(1024)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sizesTable.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.dir
+}
+
+func TestDiffRuns(t *testing.T) {
+	base := writeTestRun(t, formatCSV, map[uint64]uint64{1: 100, 2: 200, 3: 300})
+	diffRuns := func(newDir string, threshold string) (runsDiffReport, error) {
+		out := t.TempDir()
+		err := runDiffRuns([]string{"--base", base, "--new", newDir, "--threshold", threshold, "--out", out})
+		var report runsDiffReport
+		if b, readErr := os.ReadFile(filepath.Join(out, "diffruns.json")); readErr == nil {
+			if err := json.Unmarshal(b, &report); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return report, err
+	}
+
+	// Txs 1 and 4 are in a single run, and the gas of tx 3 changed.
+	report, err := diffRuns(writeTestRun(t, formatCSV, map[uint64]uint64{2: 200, 3: 303, 4: 100}), "10")
+	if err == nil || report.Passed {
+		t.Fatalf("expected the diff of runs with different txs to fail")
+	}
+	if report.OnlyInBase != 1 || report.OnlyInNew != 1 || report.ChangedTxs != 1 || report.ChangedContracts != 0 {
+		t.Fatalf("expected 1 tx only in base, 1 only in new and 1 changed, got %d, %d and %d, and %d changed contracts",
+			report.OnlyInBase, report.OnlyInNew, report.ChangedTxs, report.ChangedContracts)
+	}
+
+	// The total gas changes 0.5%, which passes a 1% threshold but not a 0.1% one.
+	changed := writeTestRun(t, formatCSV, map[uint64]uint64{1: 100, 2: 200, 3: 303})
+	if report, err := diffRuns(changed, "1"); err != nil || !report.Passed || report.ChangedTxs != 1 {
+		t.Fatalf("expected the diff to pass with 1 changed tx, got %d changed txs: %v", report.ChangedTxs, err)
+	}
+	if report, err := diffRuns(changed, "0.1"); err == nil || report.Passed {
+		t.Fatalf("expected the diff to fail under a 0.1%% threshold")
+	}
+
+	for _, format := range []string{formatParquet, formatSQLite} {
+		if _, err := diffRuns(writeTestRun(t, format, nil), "1"); err == nil || !strings.Contains(err.Error(), "can't be read") {
+			t.Fatalf("expected %s runs to be rejected, got %v", format, err)
+		}
+	}
+}
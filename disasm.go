@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/analysis/eof"
+	"github.com/jsign/verkle-chunking-analysis/analysis/z32bytechunker"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+// runDisasm prints the instructions of a contract annotated with its code chunks, and optionally
+// how many times every instruction is executed in a trace.
+func runDisasm(args []string) error {
+	flags := flag.NewFlagSet("disasm", flag.ExitOnError)
+	pcTraceFolderFlag := flags.String("tracespath", "", "Full path of the folder containing the traces")
+	contractFlag := flags.String("contract", "", "Address of the contract to disassemble. Defaults to the destination of --trace.")
+	traceFlag := flags.String("trace", "", "Name of a trace in --tracespath to count the executions of every instruction")
+	codeLayoutFlag := flags.String("code-layout", "eip6800", "Code key layout used to compute the tree index and sub-index of chunks (eip6800, separatestems, codehash, header<N>).")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *pcTraceFolderFlag == "" {
+		return fmt.Errorf("expected --tracespath <folder> flag")
+	}
+	layout, err := analysis.ParseCodeKeyLayout(*codeLayoutFlag)
+	if err != nil {
+		return err
+	}
+
+	var trace *pipeline.Trace
+	if *traceFlag != "" {
+		txOutput, err := pipeline.ReadTrace(path.Join(*pcTraceFolderFlag, *traceFlag))
+		if err != nil {
+			return fmt.Errorf("could not read trace: %s", err)
+		}
+		trace = &txOutput
+	}
+	var addr common.Address
+	switch {
+	case *contractFlag != "":
+		if !common.IsHexAddress(*contractFlag) {
+			return fmt.Errorf("invalid contract address %s", *contractFlag)
+		}
+		addr = common.HexToAddress(*contractFlag)
+	case trace != nil:
+		addr = trace.To
+	default:
+		return fmt.Errorf("expected --contract <address> or --trace <name> flag")
+	}
+
+	code, err := loadContractBytecode(*pcTraceFolderFlag, addr)
+	if err != nil {
+		return err
+	}
+	var execCounts map[uint64]uint64
+	if trace != nil {
+		execCounts = countExecutions(code, trace.ContractsPCs[addr])
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if err := disassemble(w, addr, code, layout, execCounts); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("could not write disassembly: %s", err)
+	}
+	return nil
+}
+
+// loadContractBytecode loads the code of a single contract from the code corpus.
+func loadContractBytecode(folderPath string, addr common.Address) ([]byte, error) {
+	contractBytecodes, err := loadContractsBytecodes(folderPath, []common.Address{addr})
+	if err != nil {
+		return nil, err
+	}
+	bytecode, ok := contractBytecodes[addr]
+	if !ok {
+		return nil, fmt.Errorf("contract %v not found in the code corpus", addr)
+	}
+	return bytecode, nil
+}
+
+// loadContractsBytecodes loads the code of the given contracts from the code corpus. Contracts
+// missing from the corpus aren't in the returned map.
+func loadContractsBytecodes(folderPath string, addrs []common.Address) (map[common.Address][]byte, error) {
+	dirEntries, err := os.ReadDir(path.Join(folderPath, "code"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory %s: %w", path.Join(folderPath, "code"), err)
+	}
+	contractBytecodes := make(map[common.Address][]byte, len(addrs))
+	for _, dirEntry := range dirEntries {
+		addr := common.HexToAddress(dirEntry.Name())
+		if !slices.Contains(addrs, addr) {
+			continue
+		}
+		bytecode, err := os.ReadFile(path.Join(folderPath, "code", dirEntry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read file %s: %w", path.Join(folderPath, "code", dirEntry.Name()), err)
+		}
+		contractBytecodes[addr] = bytecode
+	}
+	return contractBytecodes, nil
+}
+
+// countExecutions counts the executions of every instruction of the code from its traced PCs.
+// PCs of EOF containers are relative to their code section, so they're counted at their
+// container offset.
+func countExecutions(code []byte, pcs []uint64) map[uint64]uint64 {
+	var execution *eof.Execution
+	if container, err := eof.Parse(code); err == nil {
+		execution = eof.NewExecution(container, code)
+	}
+	execCounts := map[uint64]uint64{}
+	for _, pc := range pcs {
+		if execution != nil {
+			offset, ok := execution.Offset(pc)
+			if !ok {
+				continue
+			}
+			pc = offset
+		}
+		execCounts[pc]++
+	}
+	return execCounts
+}
+
+// disassemble writes the annotated disassembly of the code. execCounts is nil if there's no
+// trace to count the executions of every instruction from.
+func disassemble(w io.Writer, addr common.Address, code []byte, layout analysis.CodeKeyLayout, execCounts map[uint64]uint64) error {
+	if container, err := eof.Parse(code); err == nil {
+		disassembleEOF(w, addr, container, layout, execCounts)
+		return nil
+	}
+
+	tableEntries, tableSize, err := z32bytechunker.TableInvalidJumpdests(code)
+	if err != nil {
+		return fmt.Errorf("could not decode JUMPDEST table: %s", err)
+	}
+	firstValidOffsets := make(map[int]int, len(tableEntries))
+	for _, entry := range tableEntries {
+		firstValidOffsets[entry.CodeChunk] = entry.FirstValidInstructionOffset
+	}
+	chunkedCode := trie.ChunkifyCode(code)
+
+	fmt.Fprintf(w, "Contract %s: %d bytes of legacy code, layout %s\n", addr.Hex(), len(code), layout.Name())
+	fmt.Fprintf(w, "  31-byte chunks: %d\n", len(chunkedCode)/32)
+	fmt.Fprintf(w, "  32-byte chunks: %d, JUMPDEST table of %d bytes with %d entries in chunks 0 to %d, code starts at offset %d\n",
+		(tableSize+len(code)+31)/32, tableSize, len(tableEntries), max(tableSize-1, 0)/32, tableSize)
+	if execCounts != nil {
+		var executed uint64
+		for _, count := range execCounts {
+			executed += count
+		}
+		fmt.Fprintf(w, "  %d executed instructions in the trace\n", executed)
+	}
+	fmt.Fprintf(w, "\n")
+
+	chunkHeaders := func(pos, pushPC int) {
+		inPushdata := ""
+		if pushPC >= 0 {
+			inPushdata = fmt.Sprintf(", starts in the PUSHDATA of pc %d", pushPC)
+		}
+		if pos%31 == 0 {
+			chunkNumber := pos / 31
+			treeIndex, subIndex := layout.ChunkIndexes(uint64(chunkNumber))
+			fmt.Fprintf(w, "--- 31-byte chunk %d (tree index %s, sub-index %d), %d leading PUSHDATA bytes%s ---\n",
+				chunkNumber, treeIndex.Dec(), subIndex, chunkedCode[chunkNumber*32], inPushdata)
+		}
+		// The 32bytechunker places the code after the table, so its chunks don't start at the
+		// 32-byte boundaries of the code, which the table entries are keyed by.
+		if chunkPos := tableSize + pos; pos == 0 || chunkPos%32 == 0 {
+			chunkNumber := chunkPos / 32
+			treeIndex, subIndex := layout.ChunkIndexes(uint64(chunkNumber))
+			afterTable := ""
+			if chunkPos%32 != 0 {
+				afterTable = fmt.Sprintf(", code starts at offset %d after the JUMPDEST table", chunkPos%32)
+			}
+			fmt.Fprintf(w, "--- 32-byte chunk %d (tree index %s, sub-index %d)%s%s ---\n",
+				chunkNumber, treeIndex.Dec(), subIndex, afterTable, inPushdata)
+		}
+		if offset, ok := firstValidOffsets[pos/32]; ok && pos%32 == 0 {
+			fmt.Fprintf(w, "--- JUMPDEST table entry of code bytes %d to %d, first valid instruction at offset %d ---\n",
+				pos, min(pos+32, len(code))-1, offset)
+		}
+	}
+
+	for pc := 0; pc < len(code); {
+		chunkHeaders(pc, -1)
+
+		op := code[pc]
+		end := pc + 1
+		instruction := opcodeName(op)
+		var notes []string
+		if op >= z32bytechunker.PUSH1 && op <= z32bytechunker.PUSH32 {
+			end = min(pc+1+int(op-z32bytechunker.PUSH1+1), len(code))
+			instruction += " 0x" + hex.EncodeToString(code[pc+1:end])
+			if end-pc-1 < int(op-z32bytechunker.PUSH1+1) {
+				notes = append(notes, "truncated PUSHDATA")
+			}
+			if pc/31 != (end-1)/31 {
+				notes = append(notes, "PUSHDATA crosses 31-byte chunks")
+			}
+			if (tableSize+pc)/32 != (tableSize+end-1)/32 {
+				notes = append(notes, "PUSHDATA crosses 32-byte chunks")
+			}
+			var invalidJumpdests []string
+			for i := pc + 1; i < end; i++ {
+				if code[i] == z32bytechunker.JUMPDEST {
+					invalidJumpdests = append(invalidJumpdests, fmt.Sprint(i))
+				}
+			}
+			if len(invalidJumpdests) > 0 {
+				notes = append(notes, "invalid JUMPDEST at pc "+strings.Join(invalidJumpdests, ", "))
+			}
+		}
+
+		fmt.Fprintf(w, "%6d  ", pc)
+		if execCounts != nil {
+			fmt.Fprintf(w, "%8d  ", execCounts[uint64(pc)])
+		}
+		if len(notes) > 0 {
+			fmt.Fprintf(w, "%-48s ; %s\n", instruction, strings.Join(notes, "; "))
+		} else {
+			fmt.Fprintf(w, "%s\n", instruction)
+		}
+
+		for pos := pc + 1; pos < end; pos++ {
+			chunkHeaders(pos, pc)
+		}
+		pc = end
+	}
+	return nil
+}
+
+// disassembleEOF writes the sections and chunks of an EOF container. Code sections aren't
+// disassembled, since EOF instructions have immediates that legacy opcodes don't have.
+func disassembleEOF(w io.Writer, addr common.Address, container *eof.Container, layout analysis.CodeKeyLayout, execCounts map[uint64]uint64) {
+	fmt.Fprintf(w, "Contract %s: EOF container of %d chunks, layout %s\n\n", addr.Hex(), container.NumChunks, layout.Name())
+	for _, section := range container.Sections {
+		fmt.Fprintf(w, "--- %s section at offset %d, %d bytes ---\n", section.Kind, section.Offset, section.Size)
+		for start := 0; start < section.Size; start += eof.ChunkSize {
+			chunkNumber := section.FirstChunk + start/eof.ChunkSize
+			end := min(start+eof.ChunkSize, section.Size)
+			treeIndex, subIndex := layout.ChunkIndexes(uint64(chunkNumber))
+			fmt.Fprintf(w, "  chunk %d (tree index %s, sub-index %d): offsets [%d, %d)",
+				chunkNumber, treeIndex.Dec(), subIndex, section.Offset+start, section.Offset+end)
+			if execCounts != nil {
+				var executed uint64
+				for pc := section.Offset + start; pc < section.Offset+end; pc++ {
+					executed += execCounts[uint64(pc)]
+				}
+				fmt.Fprintf(w, ", %d executed instructions", executed)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+}
+
+func opcodeName(op byte) string {
+	name := vm.OpCode(op).String()
+	if strings.HasPrefix(name, "opcode ") {
+		return fmt.Sprintf("UNKNOWN 0x%02x", op)
+	}
+	return name
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+const (
+	groupByTo       = "to"
+	groupByContract = "contract"
+
+	// groupByTopN is the number of top ranked addresses printed for every grouping.
+	groupByTopN = 10
+)
+
+var groupByKeys = []string{groupByTo, groupByContract}
+
+// reportOptions configures the optional reports generated from the results.
+type reportOptions struct {
+	// groupBy are the keys to group the results by.
+	groupBy []string
+	// labels are human readable names of addresses, used in the reports.
+	labels map[common.Address]string
+	// heatmaps enables the aggregation of the chunks stats of every tx into chunk heatmaps.
+	heatmaps bool
+}
+
+type groupStats struct {
+	NumTxs     int
+	ReceiptGas uint64
+	// Gas is the code access gas of every chunker.
+	Gas []uint64
+}
+
+// groupRank orders the groups by descending receipt gas, and then by address.
+type groupRank struct {
+	ReceiptGas uint64
+	Addr       common.Address
+}
+
+func compareGroupRanks(a, b groupRank) int {
+	if a.ReceiptGas != b.ReceiptGas {
+		return cmp.Compare(b.ReceiptGas, a.ReceiptGas)
+	}
+	return compareAddresses(a.Addr, b.Addr)
+}
+
+// groupStatsBytes estimates the memory of the stats of a group, including its key and the map
+// overhead.
+func groupStatsBytes(numChunkers int) int64 {
+	return int64(120 + 8*numChunkers)
+}
+
+// loadLabels loads a CSV file with (address, label) lines. A header line is skipped.
+func loadLabels(labelsPath string) (map[common.Address]string, error) {
+	f, err := os.Open(labelsPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open labels file: %s", err)
+	}
+	defer f.Close()
+
+	labels := map[common.Address]string{}
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	for i := 0; ; i++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read csv line: %s", err)
+		}
+		addr := strings.TrimSpace(record[0])
+		if !common.IsHexAddress(addr) {
+			if i == 0 {
+				continue // Header.
+			}
+			return nil, fmt.Errorf("invalid address %s", addr)
+		}
+		labels[common.HexToAddress(addr)] = strings.TrimSpace(record[1])
+	}
+	return labels, nil
+}
+
+// genGroupByTable aggregates the results by tx destination or executed contract, and writes them
+// ranked by receipt gas. The groups are aggregated and then ranked within aggregationMemory, or
+// spilled to disk, unless it's 0.
+func genGroupByTable(results <-chan pipeline.Result, groupBy string, chunkerNames []string, labels map[common.Address]string, aggregationMemory int64, out outputFiles) (err error) {
+	// Both steps keep their entries in memory while the groups are ranked.
+	stepMemory := splitMemory(aggregationMemory, 2)
+	statsBytes := func(groupStats) int64 { return groupStatsBytes(len(chunkerNames)) }
+	groups := newSpillSorter(out.dir, stepMemory, compareAddresses, statsBytes, func(a, b groupStats) groupStats {
+		a.NumTxs += b.NumTxs
+		a.ReceiptGas += b.ReceiptGas
+		for i := range a.Gas {
+			a.Gas[i] += b.Gas[i]
+		}
+		return a
+	})
+	// Groups are ranked once, so their stats are never combined.
+	ranking := newSpillSorter(out.dir, stepMemory, compareGroupRanks, statsBytes, func(a, _ groupStats) groupStats { return a })
+	defer closeSpillSorter(groups, &err)
+	defer closeSpillSorter(ranking, &err)
+
+	add := func(addr common.Address, receiptGas uint64, chunkerGas func(i int) uint64) error {
+		stats := groupStats{NumTxs: 1, ReceiptGas: receiptGas, Gas: make([]uint64, len(chunkerNames))}
+		for i := range stats.Gas {
+			stats.Gas[i] = chunkerGas(i)
+		}
+		return groups.add(addr, stats)
+	}
+	for result := range results {
+		switch groupBy {
+		case groupByTo:
+			if err := add(result.To, result.ReceiptGas, func(i int) uint64 { return result.ChunkersMetrics[i].Gas }); err != nil {
+				return err
+			}
+		case groupByContract:
+			if len(result.ChunkersMetrics) == 0 {
+				continue
+			}
+			for addr := range result.ChunkersMetrics[0].ContractsStats {
+				if err := add(addr, result.ReceiptGas, func(i int) uint64 { return result.ChunkersMetrics[i].ContractsStats[addr].Gas }); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unknown group by key %s", groupBy)
+		}
+	}
+	err = groups.each(func(addr common.Address, stats groupStats) error {
+		return ranking.add(groupRank{ReceiptGas: stats.ReceiptGas, Addr: addr}, stats)
+	})
+	if err != nil {
+		return err
+	}
+
+	keyColumn := "to"
+	if groupBy == groupByContract {
+		keyColumn = "contract_addr"
+	}
+	columns := []column{
+		{name: keyColumn, kind: columnAddress},
+		{name: "label", kind: columnString},
+		{name: "num_txs", kind: columnInt},
+		{name: "receipt_gas", kind: columnUint},
+	}
+	for _, cn := range chunkerNames {
+		columns = append(columns, column{name: fmt.Sprintf("%s_gas", cn), kind: columnUint})
+	}
+	for _, cn := range chunkerNames {
+		columns = append(columns, column{name: fmt.Sprintf("%s_overhead_pct", cn), kind: columnFloat})
+	}
+	groupByTable, err := out.createTable("group_by_"+groupBy, columns)
+	if err != nil {
+		return err
+	}
+	defer closeTable(groupByTable, &err)
+
+	// The ranking is printed at once, since other reports are printed concurrently.
+	var top strings.Builder
+	var numTop int
+	err = ranking.each(func(rank groupRank, stats groupStats) error {
+		addr := rank.Addr
+		row := []any{addr, labels[addr], stats.NumTxs, stats.ReceiptGas}
+		for _, gas := range stats.Gas {
+			row = append(row, gas)
+		}
+		for _, gas := range stats.Gas {
+			row = append(row, percentage(int64(gas), stats.ReceiptGas))
+		}
+		if err := groupByTable.Write(row); err != nil {
+			return err
+		}
+
+		if numTop < groupByTopN {
+			numTop++
+			name := addr.Hex()
+			if label, ok := labels[addr]; ok {
+				name = fmt.Sprintf("%s (%s)", label, name)
+			}
+			fmt.Fprintf(&top, "  %s: %d txs, %d receipt gas, %s\n", name, stats.NumTxs, stats.ReceiptGas, formatOverheads(chunkerNames, stats))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Top %d by receipt gas, grouped by %s:\n%s", numTop, groupBy, top.String())
+	return nil
+}
+
+// formatOverheads formats the code access gas overhead of every chunker.
+func formatOverheads(chunkerNames []string, stats groupStats) string {
+	overheads := make([]string, len(chunkerNames))
+	for i, cn := range chunkerNames {
+		overheads[i] = fmt.Sprintf("%s %.2f%%", cn, percentage(int64(stats.Gas[i]), stats.ReceiptGas))
+	}
+	return strings.Join(overheads, ", ")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+const (
+	// heatmapMaxContracts is the number of contracts, with the most code access gas, rendered in
+	// the HTML view.
+	heatmapMaxContracts = 100
+	// heatmapChunksPerLine is the number of chunks rendered per line of a contract heatmap.
+	heatmapChunksPerLine = 128
+	heatmapCellWidth     = 6
+	heatmapCellHeight    = 12
+)
+
+// contractHeatmap aggregates the accesses to the chunks of a contract in a chunker.
+type contractHeatmap struct {
+	NumChunks int
+	Gas       uint64
+	Chunks    map[int]chunkHeat
+}
+
+type chunkHeat struct {
+	// Touches is the number of txs accessing the chunk.
+	Touches       uint64
+	AccessedBytes uint64
+	Gas           uint64
+}
+
+// contractHeatmapsBytes estimates the memory of the heatmaps of a contract in every chunker,
+// including the address key and the map overheads.
+func contractHeatmapsBytes(heatmaps []contractHeatmap) int64 {
+	size := int64(100)
+	for _, heatmap := range heatmaps {
+		size += 80 + 64*int64(len(heatmap.Chunks))
+	}
+	return size
+}
+
+// mergeContractHeatmaps adds the chunk accesses of b to a.
+func mergeContractHeatmaps(a, b []contractHeatmap) []contractHeatmap {
+	for i := range a {
+		a[i].Gas += b[i].Gas
+		// Empty maps are decoded as nil from the spilled runs.
+		if a[i].Chunks == nil {
+			a[i].Chunks = make(map[int]chunkHeat, len(b[i].Chunks))
+		}
+		for chunkNumber, bChunk := range b[i].Chunks {
+			chunk := a[i].Chunks[chunkNumber]
+			chunk.Touches += bChunk.Touches
+			chunk.AccessedBytes += bChunk.AccessedBytes
+			chunk.Gas += bChunk.Gas
+			a[i].Chunks[chunkNumber] = chunk
+		}
+	}
+	return a
+}
+
+// heatmapsOfContract are the heatmaps of a contract in every chunker.
+type heatmapsOfContract struct {
+	addr     common.Address
+	heatmaps []contractHeatmap
+}
+
+// genChunkHeatmaps aggregates the chunks stats of every contract and chunker while results are
+// streamed, and writes them as a table and as an HTML view. The heatmaps are aggregated within
+// aggregationMemory, or spilled to disk, unless it's 0.
+func genChunkHeatmaps(results <-chan pipeline.Result, chunkerNames []string, labels map[common.Address]string, aggregationMemory int64, out outputFiles) (err error) {
+	heatmaps := newSpillSorter(out.dir, aggregationMemory, compareAddresses, contractHeatmapsBytes, mergeContractHeatmaps)
+	defer closeSpillSorter(heatmaps, &err)
+	for result := range results {
+		if len(result.ChunkersMetrics) == 0 {
+			continue
+		}
+		for addr := range result.ChunkersMetrics[0].ContractsStats {
+			txHeatmaps := make([]contractHeatmap, len(chunkerNames))
+			for i, cm := range result.ChunkersMetrics {
+				stats := cm.ContractsStats[addr]
+				heatmap := contractHeatmap{NumChunks: stats.ChunkedSizeBytes / 32, Gas: stats.Gas, Chunks: make(map[int]chunkHeat, len(stats.ChunksStats))}
+				for _, chunkStats := range stats.ChunksStats {
+					chunk := heatmap.Chunks[chunkStats.ChunkNumber]
+					chunk.Touches++
+					chunk.AccessedBytes += uint64(chunkStats.AccessedBytes)
+					chunk.Gas += chunkStats.ChargedGas
+					heatmap.Chunks[chunkStats.ChunkNumber] = chunk
+				}
+				txHeatmaps[i] = heatmap
+			}
+			if err := heatmaps.add(addr, txHeatmaps); err != nil {
+				return err
+			}
+		}
+	}
+
+	columns := []column{
+		{name: "contract_addr", kind: columnAddress},
+		{name: "chunker", kind: columnString},
+		{name: "chunk_number", kind: columnInt},
+		{name: "touches", kind: columnUint},
+		{name: "avg_accessed_bytes", kind: columnFloat},
+		{name: "gas", kind: columnUint},
+	}
+	heatmapsTable, err := out.createTable("chunk_heatmaps", columns)
+	if err != nil {
+		return err
+	}
+	defer closeTable(heatmapsTable, &err)
+	// Contracts are rendered from the most to the least code access gas in the first chunker, so
+	// only the ones with the most gas are kept while the rest are written.
+	var rendered []heatmapsOfContract
+	err = heatmaps.each(func(addr common.Address, contractHeatmaps []contractHeatmap) error {
+		for i, heatmap := range contractHeatmaps {
+			for _, chunkNumber := range heatmap.sortedChunks() {
+				chunk := heatmap.Chunks[chunkNumber]
+				row := []any{addr, chunkerNames[i], chunkNumber, chunk.Touches, float64(chunk.AccessedBytes) / float64(chunk.Touches), chunk.Gas}
+				if err := heatmapsTable.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+
+		gas := contractHeatmaps[0].Gas
+		i := sort.Search(len(rendered), func(i int) bool { return rendered[i].heatmaps[0].Gas < gas })
+		if i < heatmapMaxContracts {
+			rendered = slices.Insert(rendered, i, heatmapsOfContract{addr: addr, heatmaps: contractHeatmaps})
+			rendered = rendered[:min(len(rendered), heatmapMaxContracts)]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return genChunkHeatmapsHTML(rendered, chunkerNames, labels, out)
+}
+
+func (h contractHeatmap) sortedChunks() []int {
+	chunkNumbers := make([]int, 0, len(h.Chunks))
+	for chunkNumber := range h.Chunks {
+		chunkNumbers = append(chunkNumbers, chunkNumber)
+	}
+	sort.Ints(chunkNumbers)
+	return chunkNumbers
+}
+
+func genChunkHeatmapsHTML(contracts []heatmapsOfContract, chunkerNames []string, labels map[common.Address]string, out outputFiles) error {
+	f, err := out.create("chunk_heatmaps.html")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Chunk heatmaps</title>\n")
+	fmt.Fprintf(w, "<style>body { font-family: sans-serif; } svg { display: block; margin-bottom: 8px; }</style>\n</head>\n<body>\n")
+	fmt.Fprintf(w, "<h1>Chunk heatmaps</h1>\n<p>Number of txs accessing every code chunk, from cold (gray) to hot (red). Hover a chunk to see its stats.</p>\n")
+	for _, contract := range contracts {
+		addr := contract.addr
+		title := addr.Hex()
+		if label, ok := labels[addr]; ok {
+			title = fmt.Sprintf("%s (%s)", label, title)
+		}
+		fmt.Fprintf(w, "<h2>%s</h2>\n", html.EscapeString(title))
+
+		var maxTouches uint64
+		for _, heatmap := range contract.heatmaps {
+			for _, chunk := range heatmap.Chunks {
+				maxTouches = max(maxTouches, chunk.Touches)
+			}
+		}
+		for i, heatmap := range contract.heatmaps {
+			fmt.Fprintf(w, "<h3>%s: %d chunks, %d gas</h3>\n", html.EscapeString(chunkerNames[i]), heatmap.NumChunks, heatmap.Gas)
+			writeHeatmapSVG(w, heatmap, maxTouches)
+		}
+	}
+	fmt.Fprintf(w, "</body>\n</html>\n")
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("could not write heatmaps: %s", err)
+	}
+	return nil
+}
+
+// writeHeatmapSVG renders the chunks of a contract as cells colored by their number of touches in
+// a log scale, relative to maxTouches.
+func writeHeatmapSVG(w *bufio.Writer, heatmap contractHeatmap, maxTouches uint64) {
+	// Accessed chunks can be past the chunked code if PCs are out of bounds.
+	numChunks := heatmap.NumChunks
+	for chunkNumber := range heatmap.Chunks {
+		numChunks = max(numChunks, chunkNumber+1)
+	}
+	lines := max(1, (numChunks+heatmapChunksPerLine-1)/heatmapChunksPerLine)
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\">\n",
+		heatmapChunksPerLine*heatmapCellWidth, lines*heatmapCellHeight)
+	for chunkNumber := 0; chunkNumber < numChunks; chunkNumber++ {
+		x := (chunkNumber % heatmapChunksPerLine) * heatmapCellWidth
+		y := (chunkNumber / heatmapChunksPerLine) * heatmapCellHeight
+		chunk, ok := heatmap.Chunks[chunkNumber]
+		if !ok {
+			fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"#e0e0e0\"><title>chunk %d: not accessed</title></rect>\n",
+				x, y, heatmapCellWidth-1, heatmapCellHeight-1, chunkNumber)
+			continue
+		}
+		// Hue goes from yellow (60) for the least touched chunks to red (0) for the most touched ones.
+		heat := math.Log1p(float64(chunk.Touches)) / math.Log1p(float64(maxTouches))
+		fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"hsl(%.0f, 100%%, 50%%)\"><title>chunk %d: %d txs, %.1f avg accessed bytes, %d gas</title></rect>\n",
+			x, y, heatmapCellWidth-1, heatmapCellHeight-1, 60*(1-heat),
+			chunkNumber, chunk.Touches, float64(chunk.AccessedBytes)/float64(chunk.Touches), chunk.Gas)
+	}
+	fmt.Fprintf(w, "</svg>\n")
+}
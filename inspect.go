@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+const (
+	inspectFormatText = "text"
+	inspectFormatJSON = "json"
+)
+
+type traceInspection struct {
+	Trace      string               `json:"trace"`
+	To         common.Address       `json:"to"`
+	ReceiptGas uint64               `json:"receipt_gas"`
+	NumPCs     int                  `json:"num_pcs"`
+	Contracts  []contractInspection `json:"contracts"`
+	// MissingContracts are the touched contracts without code in the corpus, which prevent
+	// running the chunkers.
+	MissingContracts []common.Address    `json:"missing_contracts,omitempty"`
+	Chunkers         []chunkerInspection `json:"chunkers,omitempty"`
+}
+
+type contractInspection struct {
+	Address   common.Address `json:"address"`
+	CodeSize  int            `json:"code_size"`
+	NumPCs    int            `json:"num_pcs"`
+	UniquePCs int            `json:"unique_pcs"`
+	MinPC     uint64         `json:"min_pc"`
+	MaxPC     uint64         `json:"max_pc"`
+	// OutOfRangePCs are the distinct traced PCs past the end of the code, in ascending order.
+	OutOfRangePCs []uint64 `json:"out_of_range_pcs"`
+}
+
+type chunkerInspection struct {
+	Name         string  `json:"name"`
+	Gas          uint64  `json:"gas"`
+	BranchGas    uint64  `json:"branch_gas"`
+	ChunkGas     uint64  `json:"chunk_gas"`
+	TableChunks  uint64  `json:"table_chunks"`
+	WitnessBytes uint64  `json:"witness_bytes"`
+	OverheadPct  float64 `json:"overhead_pct"`
+	// ContractsGas is the code access gas of every touched contract, in the order of Contracts.
+	ContractsGas []uint64 `json:"contracts_gas"`
+}
+
+// runInspect decodes a trace and prints its contents, and the code access gas of every chunker
+// for it.
+func runInspect(args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	pcTraceFolderFlag := flags.String("tracespath", "", "Full path of the folder containing the traces")
+	traceFlag := flags.String("trace", "", "Name of the trace in --tracespath to inspect")
+	codeLayoutsFlag := flags.String("code-layouts", "eip6800", "Comma separated list of code key layouts to run every chunker under (eip6800, separatestems, codehash, header<N>).")
+	bitmapChunkersFlag := flags.Bool("bitmap-chunkers", false, bitmapChunkersUsage)
+	formatFlag := flags.String("format", inspectFormatText, "Output format (text|json)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *pcTraceFolderFlag == "" || *traceFlag == "" {
+		return fmt.Errorf("expected --tracespath <folder> and --trace <name> flags")
+	}
+	if *formatFlag != inspectFormatText && *formatFlag != inspectFormatJSON {
+		return fmt.Errorf("unsupported output format %s", *formatFlag)
+	}
+	layouts, err := parseCodeKeyLayouts(*codeLayoutsFlag)
+	if err != nil {
+		return err
+	}
+
+	trace, err := pipeline.ReadTrace(path.Join(*pcTraceFolderFlag, *traceFlag))
+	if err != nil {
+		return fmt.Errorf("could not read trace: %s", err)
+	}
+	contractBytecodes, err := loadContractsBytecodes(*pcTraceFolderFlag, pipeline.SortedAddresses(trace.ContractsPCs))
+	if err != nil {
+		return err
+	}
+	inspection, err := inspectTrace(*traceFlag, trace, contractBytecodes, pipeline.NewChunkers(layouts, *bitmapChunkersFlag))
+	if err != nil {
+		return err
+	}
+
+	if *formatFlag == inspectFormatJSON {
+		b, err := json.MarshalIndent(inspection, "", "  ")
+		if err != nil {
+			return fmt.Errorf("could not encode inspection: %s", err)
+		}
+		_, err = os.Stdout.Write(append(b, '\n'))
+		return err
+	}
+	_, err = io.WriteString(os.Stdout, inspection.text())
+	return err
+}
+
+// inspectTrace summarizes the PCs of every touched contract, and runs the chunkers over the trace
+// if the code of all of them is available.
+func inspectTrace(name string, trace pipeline.Trace, contractBytecodes map[common.Address][]byte, chunkers []analysis.Chunker) (traceInspection, error) {
+	inspection := traceInspection{Trace: name, To: trace.To, ReceiptGas: trace.ReceiptGas}
+	contracts := pipeline.SortedAddresses(trace.ContractsPCs)
+	for _, addr := range contracts {
+		pcs := trace.ContractsPCs[addr]
+		code, hasCode := contractBytecodes[addr]
+		if !hasCode {
+			inspection.MissingContracts = append(inspection.MissingContracts, addr)
+		}
+		ci := contractInspection{Address: addr, CodeSize: len(code), NumPCs: len(pcs), OutOfRangePCs: []uint64{}}
+		uniquePCs := map[uint64]struct{}{}
+		for i, pc := range pcs {
+			if i == 0 || pc < ci.MinPC {
+				ci.MinPC = pc
+			}
+			ci.MaxPC = max(ci.MaxPC, pc)
+			if _, ok := uniquePCs[pc]; !ok {
+				uniquePCs[pc] = struct{}{}
+				if hasCode && pc >= uint64(len(code)) {
+					ci.OutOfRangePCs = append(ci.OutOfRangePCs, pc)
+				}
+			}
+		}
+		ci.UniquePCs = len(uniquePCs)
+		slices.Sort(ci.OutOfRangePCs)
+		inspection.NumPCs += len(pcs)
+		inspection.Contracts = append(inspection.Contracts, ci)
+	}
+	if len(inspection.MissingContracts) > 0 {
+		return inspection, nil
+	}
+
+	metrics, err := pipeline.RunChunkers(chunkers, trace.ContractsPCs, contractBytecodes, false)
+	if err != nil {
+		return traceInspection{}, err
+	}
+	for _, cm := range metrics {
+		ch := chunkerInspection{
+			Name:         cm.ChunkerName,
+			Gas:          cm.Gas,
+			BranchGas:    cm.BranchGas,
+			ChunkGas:     cm.Gas - cm.BranchGas,
+			TableChunks:  cm.TableChunksTouched,
+			WitnessBytes: cm.WitnessSizeBytes(),
+			OverheadPct:  percentage(int64(cm.Gas), trace.ReceiptGas),
+		}
+		for _, addr := range contracts {
+			ch.ContractsGas = append(ch.ContractsGas, cm.ContractsStats[addr].Gas)
+		}
+		inspection.Chunkers = append(inspection.Chunkers, ch)
+	}
+	return inspection, nil
+}
+
+func (ti traceInspection) text() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Trace %s\n", ti.Trace)
+	fmt.Fprintf(&sb, "  To: %s\n", ti.To.Hex())
+	fmt.Fprintf(&sb, "  Receipt gas: %d\n", ti.ReceiptGas)
+	fmt.Fprintf(&sb, "  Executed PCs: %d in %d contracts\n", ti.NumPCs, len(ti.Contracts))
+
+	fmt.Fprintf(&sb, "\nContracts:\n")
+	for _, ci := range ti.Contracts {
+		codeSize := fmt.Sprint(ci.CodeSize)
+		if slices.Contains(ti.MissingContracts, ci.Address) {
+			codeSize = "missing code"
+		}
+		fmt.Fprintf(&sb, "  %s: %s bytes, %d PCs (%d unique), PC range [%d, %d]",
+			ci.Address.Hex(), codeSize, ci.NumPCs, ci.UniquePCs, ci.MinPC, ci.MaxPC)
+		if len(ci.OutOfRangePCs) > 0 {
+			pcs := make([]string, len(ci.OutOfRangePCs))
+			for i, pc := range ci.OutOfRangePCs {
+				pcs[i] = fmt.Sprint(pc)
+			}
+			fmt.Fprintf(&sb, ", out-of-range PCs: %s", strings.Join(pcs, ", "))
+		}
+		fmt.Fprintf(&sb, "\n")
+	}
+
+	if len(ti.MissingContracts) > 0 {
+		fmt.Fprintf(&sb, "\nChunkers can't run, %d contracts are missing from the code corpus.\n", len(ti.MissingContracts))
+		return sb.String()
+	}
+	fmt.Fprintf(&sb, "\nChunkers:\n")
+	for _, ch := range ti.Chunkers {
+		fmt.Fprintf(&sb, "  %s: %d gas (%.2f%% of receipt gas), %d chunk gas, %d branch gas, %d table chunks, %d witness bytes\n",
+			ch.Name, ch.Gas, ch.OverheadPct, ch.ChunkGas, ch.BranchGas, ch.TableChunks, ch.WitnessBytes)
+		for i, gas := range ch.ContractsGas {
+			fmt.Fprintf(&sb, "    %s: %d gas\n", ti.Contracts[i].Address.Hex(), gas)
+		}
+	}
+	return sb.String()
+}
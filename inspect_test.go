@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+func TestInspectTrace(t *testing.T) {
+	const name = "0x000000000000000000000000000000000000000000000000000000000007a000"
+	trace, err := pipeline.ReadTrace("testdata/traces/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contractBytecodes, err := loadContractsBytecodes("testdata/traces", pipeline.SortedAddresses(trace.ContractsPCs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunkers := pipeline.NewChunkers([]analysis.CodeKeyLayout{analysis.DefaultCodeKeyLayout}, true)
+	inspection, err := inspectTrace(name, trace, contractBytecodes, chunkers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []contractInspection{
+		{Address: common.HexToAddress("0xc0de03"), CodeSize: 1201, NumPCs: 143, UniquePCs: 136, MinPC: 0, MaxPC: 1200, OutOfRangePCs: []uint64{}},
+		{Address: common.HexToAddress("0xc0de04"), CodeSize: 924, NumPCs: 18, UniquePCs: 18, MinPC: 0, MaxPC: 923, OutOfRangePCs: []uint64{}},
+		{Address: common.HexToAddress("0xc0de05"), CodeSize: 241, NumPCs: 10, UniquePCs: 8, MinPC: 0, MaxPC: 36, OutOfRangePCs: []uint64{}},
+	}
+	if len(inspection.Contracts) != len(expected) {
+		t.Fatalf("expected %d contracts, got %d", len(expected), len(inspection.Contracts))
+	}
+	for i, ci := range inspection.Contracts {
+		if !reflect.DeepEqual(ci, expected[i]) {
+			t.Fatalf("expected contract %+v, got %+v", expected[i], ci)
+		}
+	}
+	if inspection.NumPCs != 171 {
+		t.Fatalf("expected 171 PCs, got %d", inspection.NumPCs)
+	}
+
+	if len(inspection.Chunkers) != len(chunkers) {
+		t.Fatalf("expected %d chunkers, got %d", len(chunkers), len(inspection.Chunkers))
+	}
+	for _, ch := range inspection.Chunkers {
+		var contractsGas uint64
+		for _, gas := range ch.ContractsGas {
+			contractsGas += gas
+		}
+		if contractsGas != ch.Gas {
+			t.Fatalf("%s: contracts gas %d doesn't add up to the total gas %d", ch.Name, contractsGas, ch.Gas)
+		}
+	}
+
+	// PCs past the end of the code are reported once and sorted, and chunkers don't run on them.
+	contract := common.HexToAddress("0xc0de04")
+	trace.ContractsPCs[contract] = append(slices.Clone(trace.ContractsPCs[contract]), 930, 924, 930)
+	inspection, err = inspectTrace(name, trace, contractBytecodes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := inspection.Contracts[1]
+	if ci.MaxPC != 930 || !slices.Equal(ci.OutOfRangePCs, []uint64{924, 930}) {
+		t.Fatalf("expected max PC 930 and out-of-range PCs [924 930], got %d and %v", ci.MaxPC, ci.OutOfRangePCs)
+	}
+}
@@ -2,30 +2,59 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"path"
+	"os/signal"
 	"runtime"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 
 	"github.com/ethereum/go-ethereum/common"
-	"golang.org/x/sync/errgroup"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
 )
 
-type traceOutput struct {
-	ContractsPCs map[common.Address][]uint64
-	ReceiptGas   uint64
-	To           common.Address
+// subcommands are the available subcommands, which receive the rest of the command line arguments.
+var subcommands = map[string]func(args []string) error{
+	"checktable": runCheckTable,
+	"compare":    runCompare,
+	"diffruns":   runDiffRuns,
+	"disasm":     runDisasm,
+	"inspect":    runInspect,
+	"sizes":      runSizes,
+	"validate":   runValidate,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			if err := subcommand(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	pcTraceFolderFlag := flag.String("tracespath", "", "Full path of the folder containing the traces")
 	filterContractsChunksStatsFlag := flag.String("filter-contracts-chunks-stats", "", "Comma separated list of contract addresses to filter the chunks stats csv file.")
+	txBlocksFlag := flag.String("tx-blocks", "", "CSV file mapping tx hashes to block numbers. If set, runs the block-level code-by-hash sharing simulation instead of the per-tx analysis.")
+	codeLayoutsFlag := flag.String("code-layouts", "eip6800", "Comma separated list of code key layouts to run every chunker under (eip6800, separatestems, codehash, header<N>).")
+	bitmapChunkersFlag := flag.Bool("bitmap-chunkers", false, bitmapChunkersUsage)
+	outFlag := flag.String("out", ".", "Folder where the generated files are written")
+	runIDFlag := flag.String("run-id", "", "Prefix for the names of the generated files, to keep the results of different runs apart")
+	formatFlag := flag.String("format", formatCSV, fmt.Sprintf("Format of the generated result tables (%s)", strings.Join(outputFormats, "|")))
+	groupByFlag := flag.String("group-by", "", fmt.Sprintf("Comma separated list of keys to rank the results by receipt and code access gas (%s)", strings.Join(groupByKeys, "|")))
+	labelsFlag := flag.String("labels", "", "CSV file mapping addresses to labels, used in the grouped results and heatmaps")
+	heatmapsFlag := flag.Bool("heatmaps", false, "Aggregate the chunks stats of every tx into per-contract chunk heatmaps")
+	metricsAddrFlag := flag.String("metrics-addr", "", "Address to serve the progress of the run on, as Prometheus metrics on /metrics and JSON on /progress (e.g: localhost:9090)")
+	maxMemoryFlag := flag.String("max-memory", "", "Memory budget of the run (e.g: 12GB), bounding the traces in flight and spilling large aggregations to disk. Unbounded if empty")
+	progressIntervalFlag := flag.Duration("progress-interval", defaultProgressInterval, "Interval between progress log lines, or 0 to disable them")
 	flag.Parse()
 
 	if *pcTraceFolderFlag == "" {
@@ -40,227 +69,445 @@ func main() {
 		filteredContractsChunksStats[common.HexToAddress(addrStr)] = struct{}{}
 	}
 
-	pcTracePaths, contractBytecodes, err := loadData(pcTraceFolder, -1)
+	layouts, err := parseCodeKeyLayouts(*codeLayoutsFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	numProcessors := runtime.NumCPU()
-	sliceSize := len(pcTracePaths) / numProcessors
-	processorResults := make(chan pcTraceResult)
-	for i := 0; i < numProcessors; i++ {
-		if i == numProcessors-1 {
-			go processFiles(contractBytecodes, pcTracePaths[i*sliceSize:], filteredContractsChunksStats, processorResults)
-		} else {
-			go processFiles(contractBytecodes, pcTracePaths[i*sliceSize:(i+1)*sliceSize], filteredContractsChunksStats, processorResults)
+	if !slices.Contains(outputFormats, *formatFlag) {
+		log.Fatalf("unknown output format %s", *formatFlag)
+	}
+	// The code sharing simulation runs its own layouts and chunkers into a single table, so the
+	// flags of the per-tx analysis would be silently ignored.
+	if *txBlocksFlag != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if slices.Contains(codeSharingIgnoredFlags, f.Name) {
+				log.Fatalf("--%s isn't supported with --tx-blocks", f.Name)
+			}
+		})
+		if *formatFlag == formatSQLite {
+			log.Fatalf("--tx-blocks isn't supported with --format %s", formatSQLite)
+		}
+	}
+	reports := reportOptions{heatmaps: *heatmapsFlag}
+	if reports.heatmaps && *formatFlag == formatSQLite {
+		log.Fatalf("--heatmaps isn't supported with --format %s", formatSQLite)
+	}
+	if *groupByFlag != "" {
+		reports.groupBy = strings.Split(*groupByFlag, ",")
+		for _, key := range reports.groupBy {
+			if !slices.Contains(groupByKeys, key) {
+				log.Fatalf("unknown group by key %s", key)
+			}
+		}
+		if *formatFlag == formatSQLite {
+			log.Fatalf("--group-by isn't supported with --format %s, query the database instead", formatSQLite)
+		}
+	}
+	if *labelsFlag != "" {
+		if reports.labels, err = loadLabels(*labelsFlag); err != nil {
+			log.Fatal(err)
 		}
 	}
+	var maxMemory int64
+	if *maxMemoryFlag != "" {
+		if maxMemory, err = parseByteSize(*maxMemoryFlag); err != nil {
+			log.Fatal(err)
+		}
+		debug.SetMemoryLimit(maxMemory)
+	}
+	out := outputFiles{dir: *outFlag, runID: *runIDFlag, format: *formatFlag}
+	if err := os.MkdirAll(out.dir, 0755); err != nil {
+		log.Fatalf("could not create output folder: %s", err)
+	}
 
-	if err := outputResults(processorResults, len(pcTracePaths), contractBytecodes); err != nil {
+	pcTracePaths, contractBytecodes, err := loadData(pcTraceFolder, -1)
+	if err != nil {
 		log.Fatal(err)
 	}
-}
 
-func loadData(folderPath string, limit int) ([]string, map[common.Address][]byte, error) {
-	dirEntries, err := os.ReadDir(folderPath)
-	if err != nil {
-		return nil, nil, fmt.Errorf("could not read directory %s: %w", folderPath, err)
+	chunkerNames := pipeline.ChunkerNames(layouts, *bitmapChunkersFlag)
+	if *txBlocksFlag != "" {
+		chunkerNames = pipeline.ChunkerNames(codeSharingLayouts, false)
 	}
-	pcTracesPaths := make([]string, 0, len(dirEntries))
-	for i, dirEntry := range dirEntries {
-		if dirEntry.IsDir() {
-			continue
+	// The metrics are served before writing the manifest, so a bad address doesn't leave a
+	// run marked as running.
+	progress := newProgressTracker(len(pcTracePaths), runtime.NumCPU(), *progressIntervalFlag)
+	if *metricsAddrFlag != "" {
+		if err := serveMetrics(*metricsAddrFlag, progress); err != nil {
+			log.Fatal(err)
 		}
-		if limit != -1 && i >= limit {
+	}
+	manifest := newRunManifest(flag.CommandLine, out, pcTraceFolder, len(pcTracePaths), chunkerNames)
+	if err := manifest.write(out); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := interruptibleContext()
+	if *txBlocksFlag != "" {
+		err = runCodeSharing(ctx, *txBlocksFlag, pcTracePaths, contractBytecodes, out)
+	} else {
+		err = runAnalysis(ctx, pcTracePaths, contractBytecodes, filteredContractsChunksStats, layouts, *bitmapChunkersFlag, reports, maxMemory, progress, out)
+	}
+	if errors.Is(err, context.Canceled) {
+		err = errInterrupted
+	}
+	manifest.finish(err, progress.snapshot().FailedTraces)
+	if err := manifest.write(out); err != nil {
+		log.Fatal(err)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// bitmapChunkersUsage is the help of the flag enabling the bitmap chunkers in every subcommand.
+const bitmapChunkersUsage = "Also run the 32-byte chunkers storing the JUMPDEST analysis as per-chunk bitmaps (32bytebitmapchunker, 32bytebitsetchunker)"
+
+// codeSharingIgnoredFlags are the flags of the per-tx analysis that the code sharing simulation
+// doesn't use.
+var codeSharingIgnoredFlags = []string{
+	"filter-contracts-chunks-stats", "code-layouts", "bitmap-chunkers", "group-by", "labels", "heatmaps",
+	"metrics-addr", "max-memory", "progress-interval",
+}
+
+// errInterrupted is the error of runs stopped by a signal, whose results are incomplete.
+var errInterrupted = errors.New("interrupted, the results only cover part of the traces")
+
+// interruptibleContext returns a context canceled on the first SIGINT or SIGTERM, so runs stop
+// and flush the results so far. Any further signal terminates the process right away.
+func interruptibleContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		fmt.Println("Interrupted, flushing the results... (interrupt again to exit right away)")
+		cancel()
+	}()
+	return ctx
+}
+
+// byteSizeUnits are the suffixes of the sizes parsed by parseByteSize, longest first.
+var byteSizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseByteSize parses a size in bytes, with an optional unit suffix (e.g: 512MiB, 12GB).
+func parseByteSize(size string) (int64, error) {
+	number, multiplier := size, int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(size, unit.suffix) {
+			number, multiplier = strings.TrimSpace(strings.TrimSuffix(size, unit.suffix)), unit.bytes
 			break
 		}
-		pcTracesPaths = append(pcTracesPaths, path.Join(folderPath, dirEntry.Name()))
 	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
 
-	dirEntries, err = os.ReadDir(path.Join(folderPath, "code"))
-	if err != nil {
-		return nil, nil, fmt.Errorf("could not read directory %s: %w", path.Join(folderPath, "code"), err)
+// parseCodeKeyLayouts parses a comma separated list of code key layout names.
+func parseCodeKeyLayouts(names string) ([]analysis.CodeKeyLayout, error) {
+	var layouts []analysis.CodeKeyLayout
+	for _, layoutName := range strings.Split(names, ",") {
+		layout, err := analysis.ParseCodeKeyLayout(layoutName)
+		if err != nil {
+			return nil, err
+		}
+		layouts = append(layouts, layout)
 	}
+	return layouts, nil
+}
+
+func runAnalysis(
+	ctx context.Context,
+	pcTracePaths []string,
+	contractBytecodes map[common.Address][]byte,
+	filteredContractsChunksStats map[common.Address]struct{},
+	layouts []analysis.CodeKeyLayout,
+	bitmapChunkers bool,
+	reports reportOptions,
+	maxMemory int64,
+	progress *progressTracker,
+	out outputFiles) error {
+	// Half of the memory budget goes to the traces in flight, and a quarter to the aggregations
+	// that spill to disk. The rest is left for the contract bytecodes and the other reports.
+	return runWithProgress(ctx, pipeline.Options{
+		TracePaths:           pcTracePaths,
+		ContractBytecodes:    contractBytecodes,
+		Chunkers:             func() []analysis.Chunker { return pipeline.NewChunkers(layouts, bitmapChunkers) },
+		ChunksStatsContracts: filteredContractsChunksStats,
+		AllChunksStats:       reports.heatmaps,
+		MaxInFlightBytes:     splitMemory(maxMemory, 2),
+		Sinks:                analysisSinks(pipeline.ChunkerNames(layouts, bitmapChunkers), contractBytecodes, reports, splitMemory(maxMemory, 4), out),
+	}, progress)
+}
 
+// runWithProgress runs the pipeline with the workers of the progress tracker, logging its progress.
+func runWithProgress(ctx context.Context, opts pipeline.Options, progress *progressTracker) error {
+	opts.Workers = progress.workers
+	opts.OnResult = progress.record
+	opts.OnTraceError = progress.recordError
+	opts.OnDone = progress.end
+	progress.begin()
+	return pipeline.NewRunner(opts).Run(ctx)
+}
+
+func loadData(folderPath string, limit int) ([]string, map[common.Address][]byte, error) {
 	fmt.Printf("Loading contract bytecodes... ")
-	var lock sync.Mutex
-	group, _ := errgroup.WithContext(context.Background())
-	group.SetLimit(runtime.NumCPU())
-	contractBytecodes := map[common.Address][]byte{}
-	for _, dirEntry := range dirEntries {
-		dirEntry := dirEntry
-		group.Go(func() error {
-			bytecode, err := os.ReadFile(path.Join(folderPath, "code", dirEntry.Name()))
-			if err != nil {
-				return fmt.Errorf("could not read file %s: %w", path.Join(folderPath, dirEntry.Name()), err)
-			}
-			lock.Lock()
-			contractBytecodes[common.HexToAddress(dirEntry.Name())] = bytecode
-			lock.Unlock()
-			return nil
-		})
-	}
-	if err := group.Wait(); err != nil {
-		return nil, nil, fmt.Errorf("error loading contract bytecodes: %s", err)
+	pcTracePaths, contractBytecodes, err := pipeline.LoadData(folderPath, limit)
+	if err != nil {
+		return nil, nil, err
 	}
 	fmt.Printf("OK\n")
+	return pcTracePaths, contractBytecodes, nil
+}
 
-	return pcTracesPaths, contractBytecodes, nil
+func loadContractBytecodes(folderPath string) (map[common.Address][]byte, error) {
+	fmt.Printf("Loading contract bytecodes... ")
+	contractBytecodes, err := pipeline.LoadContractBytecodes(folderPath)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("OK\n")
+	return contractBytecodes, nil
 }
 
-func outputResults(
-	processorResults chan pcTraceResult,
-	expTotalResults int,
-	contractsBytecodes map[common.Address][]byte) error {
+// analysisSinks returns the sinks generating the results of the analysis. The sinks aggregating
+// per-contract results share aggregationMemory evenly.
+func analysisSinks(
+	chunkerNames []string,
+	contractsBytecodes map[common.Address][]byte,
+	reports reportOptions,
+	aggregationMemory int64,
+	out outputFiles) []pipeline.Sink {
 
-	fanout := make([]chan pcTraceResult, 3)
-	for i := range fanout {
-		fanout[i] = make(chan pcTraceResult, 1_000)
+	// The summary, and the chunked sizes table or the SQLite store.
+	aggregations := 2 + len(reports.groupBy)
+	if reports.heatmaps {
+		aggregations++
 	}
+	aggregationMemory = splitMemory(aggregationMemory, aggregations)
 
-	chunkerNames := []string{"31bytechunker", "32bytechunker"} // TODO: fix
-	group, _ := errgroup.WithContext(context.Background())
-	group.Go(func() error {
-		if err := genGasCSV(fanout[0], chunkerNames); err != nil {
-			return fmt.Errorf("error exporting gas csv: %s", err)
-		}
-		return nil
-	})
-	group.Go(func() error {
-		if err := genChunkedContractSizesCSV(fanout[1], chunkerNames, contractsBytecodes); err != nil {
-			return fmt.Errorf("error exporting contracts chunked sizes csv: %s", err)
-		}
-		return nil
-	})
-	group.Go(func() error {
-		if err := genChunksStatsCSV(fanout[2]); err != nil {
-			return fmt.Errorf("error exporting chunks stats csv: %s", err)
+	var sinks []pipeline.Sink
+	if out.format == formatSQLite {
+		sinks = append(sinks, func(results <-chan pipeline.Result) error {
+			if err := genSQLiteStore(results, chunkerNames, contractsBytecodes, aggregationMemory, out); err != nil {
+				return fmt.Errorf("error exporting sqlite store: %s", err)
+			}
+			return nil
+		})
+	} else {
+		sinks = append(sinks,
+			func(results <-chan pipeline.Result) error {
+				if err := genGasTable(results, chunkerNames, out); err != nil {
+					return fmt.Errorf("error exporting gas table: %s", err)
+				}
+				return nil
+			},
+			func(results <-chan pipeline.Result) error {
+				if err := genChunkedContractSizesTable(results, chunkerNames, contractsBytecodes, aggregationMemory, out); err != nil {
+					return fmt.Errorf("error exporting contracts chunked sizes table: %s", err)
+				}
+				return nil
+			},
+			func(results <-chan pipeline.Result) error {
+				if err := genChunksStatsTable(results, out); err != nil {
+					return fmt.Errorf("error exporting chunks stats table: %s", err)
+				}
+				return nil
+			})
+	}
+
+	sinks = append(sinks, func(results <-chan pipeline.Result) error {
+		if err := genSummary(results, chunkerNames, contractsBytecodes, aggregationMemory, out); err != nil {
+			return fmt.Errorf("error exporting summary: %s", err)
 		}
 		return nil
 	})
 
-	for i := 0; i < expTotalResults; i++ {
-		result := <-processorResults
-		if result.err != nil {
-			return fmt.Errorf("error processing: %s", result.err)
-		}
-		for i := 0; i < len(fanout); i++ {
-			fanout[i] <- result
-		}
-		if i%(expTotalResults/8) == 0 {
-			fmt.Printf("Processing traces... %d%%\n", (i*100)/expTotalResults)
-		}
-	}
-	for i := range fanout {
-		close(fanout[i])
+	for _, groupBy := range reports.groupBy {
+		groupBy := groupBy
+		sinks = append(sinks, func(results <-chan pipeline.Result) error {
+			if err := genGroupByTable(results, groupBy, chunkerNames, reports.labels, aggregationMemory, out); err != nil {
+				return fmt.Errorf("error exporting results grouped by %s: %s", groupBy, err)
+			}
+			return nil
+		})
 	}
-	if err := group.Wait(); err != nil {
-		return fmt.Errorf("error exporting results: %s", err)
+
+	if reports.heatmaps {
+		sinks = append(sinks, func(results <-chan pipeline.Result) error {
+			if err := genChunkHeatmaps(results, chunkerNames, reports.labels, aggregationMemory, out); err != nil {
+				return fmt.Errorf("error exporting chunk heatmaps: %s", err)
+			}
+			return nil
+		})
 	}
 
-	return nil
+	return sinks
 }
 
-func genGasCSV(results chan pcTraceResult, chunkerNames []string) error {
-	csvGas, err := os.OpenFile("gas_analysis.csv", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("could not create file: %s", err)
+func genGasTable(results <-chan pipeline.Result, chunkerNames []string, out outputFiles) (err error) {
+	columns := []column{
+		{name: "tx", kind: columnHash},
+		{name: "execution_length", kind: columnInt},
+		{name: "receipt_gas", kind: columnUint},
+		{name: "to", kind: columnAddress},
+		{name: "num_exec_contracts", kind: columnInt},
+	}
+	for _, cn := range chunkerNames {
+		columns = append(columns, column{name: fmt.Sprintf("%s_gas", cn), kind: columnUint})
 	}
-	defer csvGas.Close()
-	csvGasWriter := csv.NewWriter(csvGas)
-	defer csvGasWriter.Flush()
-	columns := []string{"tx", "execution_length", "receipt_gas", "to", "num_exec_contracts"}
 	for _, cn := range chunkerNames {
-		columns = append(columns, fmt.Sprintf("%s_gas", cn))
+		columns = append(columns, column{name: fmt.Sprintf("%s_branch_gas", cn), kind: columnUint})
 	}
-	if err := csvGasWriter.Write(columns); err != nil {
-		return fmt.Errorf("could not write csv header: %s", err)
+	for _, cn := range chunkerNames {
+		columns = append(columns, column{name: fmt.Sprintf("%s_table_chunks", cn), kind: columnUint})
+	}
+	gasTable, err := out.createTable("gas_analysis", columns)
+	if err != nil {
+		return err
 	}
+	defer closeTable(gasTable, &err)
 
 	for result := range results {
-		line := []string{
-			result.tx,
-			strconv.FormatUint(uint64(result.execLength), 10),
-			strconv.FormatUint(result.receiptGas, 10),
-			result.to.Hex(),
-			strconv.FormatUint(uint64(result.numExecContracts), 10),
+		row := []any{
+			common.HexToHash(result.Tx),
+			result.ExecLength,
+			result.ReceiptGas,
+			result.To,
+			result.NumExecContracts,
+		}
+		for _, cm := range result.ChunkersMetrics {
+			row = append(row, cm.Gas)
 		}
-		for _, cm := range result.chunkersMetrics {
-			line = append(line, fmt.Sprintf("%d", cm.Gas))
+		for _, cm := range result.ChunkersMetrics {
+			row = append(row, cm.BranchGas)
 		}
-		if err := csvGasWriter.Write(line); err != nil {
-			return fmt.Errorf("could not write csv line: %s", err)
+		for _, cm := range result.ChunkersMetrics {
+			row = append(row, cm.TableChunksTouched)
+		}
+		if err := gasTable.Write(row); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func genChunkedContractSizesCSV(results chan pcTraceResult, chunkerNames []string, contractBytecodes map[common.Address][]byte) error {
-	csvContractSizes, err := os.OpenFile("contracts_chunked_sizes.csv", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("could not create file: %s", err)
+// chunkedContractSizes are the chunked and table sizes of a contract for every chunker.
+type chunkedContractSizes struct {
+	ChunkedSizes []int
+	TableSizes   []int
+}
+
+// chunkedContractSizesBytes estimates the memory of the sizes of a contract for every chunker,
+// including the address key and the map overhead.
+func chunkedContractSizesBytes(numChunkers int) int64 {
+	return int64(100 + 2*8*numChunkers)
+}
+
+// genChunkedContractSizesTable writes the sizes of every executed contract. They're aggregated
+// within aggregationMemory, or spilled to disk, unless it's 0.
+func genChunkedContractSizesTable(results <-chan pipeline.Result, chunkerNames []string, contractBytecodes map[common.Address][]byte, aggregationMemory int64, out outputFiles) (err error) {
+	columns := []column{
+		{name: "contract_addr", kind: columnAddress},
+		{name: "original_size", kind: columnInt},
+	}
+	for _, cn := range chunkerNames {
+		columns = append(columns, column{name: fmt.Sprintf("%s_chunked_size", cn), kind: columnInt})
 	}
-	defer csvContractSizes.Close()
-	csvContractSizesWriter := csv.NewWriter(csvContractSizes)
-	defer csvContractSizesWriter.Flush()
-	columns := []string{"contract_addr", "original_size"}
 	for _, cn := range chunkerNames {
-		columns = append(columns, fmt.Sprintf("%s_chunked_size", cn))
+		columns = append(columns, column{name: fmt.Sprintf("%s_table_size", cn), kind: columnInt})
 	}
-	if err := csvContractSizesWriter.Write(columns); err != nil {
-		return fmt.Errorf("could not write csv header: %s", err)
+	contractSizesTable, err := out.createTable("contracts_chunked_sizes", columns)
+	if err != nil {
+		return err
 	}
+	defer closeTable(contractSizesTable, &err)
 
-	contractChunkedSizes := map[common.Address][]int{}
+	// The sizes of a contract are the same in every tx, so the first ones are kept.
+	contractsSizes := newSpillSorter(out.dir, aggregationMemory, compareAddresses,
+		func(chunkedContractSizes) int64 { return chunkedContractSizesBytes(len(chunkerNames)) },
+		func(a, _ chunkedContractSizes) chunkedContractSizes { return a })
+	defer closeSpillSorter(contractsSizes, &err)
 	for result := range results {
-		for chunkerIdx, cm := range result.chunkersMetrics {
+		txContractsSizes := map[common.Address]chunkedContractSizes{}
+		for chunkerIdx, cm := range result.ChunkersMetrics {
 			for addr, stats := range cm.ContractsStats {
-				if contractChunkedSizes[addr] == nil {
-					contractChunkedSizes[addr] = make([]int, len(chunkerNames))
+				sizes, ok := txContractsSizes[addr]
+				if !ok {
+					sizes = chunkedContractSizes{ChunkedSizes: make([]int, len(chunkerNames)), TableSizes: make([]int, len(chunkerNames))}
+					txContractsSizes[addr] = sizes
 				}
-				contractChunkedSizes[addr][chunkerIdx] = stats.ChunkedSizeBytes
+				sizes.ChunkedSizes[chunkerIdx] = stats.ChunkedSizeBytes
+				sizes.TableSizes[chunkerIdx] = stats.TableSizeBytes
+			}
+		}
+		for addr, sizes := range txContractsSizes {
+			if err := contractsSizes.add(addr, sizes); err != nil {
+				return err
 			}
 		}
 	}
-	for contractAddr, chunkedSizes := range contractChunkedSizes {
-		line := []string{contractAddr.String(), fmt.Sprintf("%d", len(contractBytecodes[contractAddr]))}
-		for _, size := range chunkedSizes {
-			line = append(line, fmt.Sprintf("%d", size))
+	return contractsSizes.each(func(contractAddr common.Address, sizes chunkedContractSizes) error {
+		row := []any{contractAddr, len(contractBytecodes[contractAddr])}
+		for _, size := range sizes.ChunkedSizes {
+			row = append(row, size)
 		}
-		if err := csvContractSizesWriter.Write(line); err != nil {
-			return fmt.Errorf("could not write csv line: %s", err)
+		for _, size := range sizes.TableSizes {
+			row = append(row, size)
 		}
-	}
-	return nil
+		return contractSizesTable.Write(row)
+	})
 }
 
-func genChunksStatsCSV(results chan pcTraceResult) error {
-	csvChunksStats, err := os.OpenFile("contracts_chunks_stats.csv", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("could not create file: %s", err)
+func genChunksStatsTable(results <-chan pipeline.Result, out outputFiles) (err error) {
+	columns := []column{
+		{name: "tx", kind: columnHash},
+		{name: "to", kind: columnAddress},
+		{name: "contract_addr", kind: columnAddress},
+		{name: "chunk_number", kind: columnInt},
+		{name: "bytes_used", kind: columnInt},
+		{name: "gas_used", kind: columnUint},
 	}
-	defer csvChunksStats.Close()
-	csvChunksStatsWriter := csv.NewWriter(csvChunksStats)
-	defer csvChunksStatsWriter.Flush()
-
-	columns := []string{"tx", "to", "contract_addr", "chunk_number", "bytes_used", "gas_used"}
-	if err := csvChunksStatsWriter.Write(columns); err != nil {
-		return fmt.Errorf("could not write csv header: %s", err)
+	chunksStatsTable, err := out.createTable("contracts_chunks_stats", columns)
+	if err != nil {
+		return err
 	}
+	defer closeTable(chunksStatsTable, &err)
 
 	for result := range results {
-		for contractAddr, stats := range result.chunkersMetrics[0].ContractsStats {
-			for _, chunkStats := range stats.ChunksStats {
-				line := []string{result.tx, result.to.Hex(), contractAddr.Hex()}
-				line = append(line, strconv.Itoa(chunkStats.ChunkNumber))
-				line = append(line, strconv.Itoa(chunkStats.AccessedBytes))
-				line = append(line, strconv.FormatUint(chunkStats.ChargedGas, 10))
-				if err := csvChunksStatsWriter.Write(line); err != nil {
-					return fmt.Errorf("could not write csv line: %s", err)
+		if !result.ChunksStatsFiltered {
+			continue
+		}
+		tx := common.HexToHash(result.Tx)
+		contractsStats := result.ChunkersMetrics[0].ContractsStats
+		for _, contractAddr := range pipeline.SortedAddresses(contractsStats) {
+			for _, chunkStats := range contractsStats[contractAddr].ChunksStats {
+				row := []any{tx, result.To, contractAddr, chunkStats.ChunkNumber, chunkStats.AccessedBytes, chunkStats.ChargedGas}
+				if err := chunksStatsTable.Write(row); err != nil {
+					return err
 				}
 			}
 		}
 	}
 	return nil
 }
+
+// closeTable closes the table, and reports the closing error if there wasn't a previous one.
+func closeTable(table tableWriter, err *error) {
+	if closeErr := table.Close(); closeErr != nil && *err == nil {
+		*err = closeErr
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+var goldenFiles = []string{
+	"gas_analysis.csv",
+	"contracts_chunked_sizes.csv",
+	"contracts_chunks_stats.csv",
+	"summary.json",
+	"summary.md",
+	"group_by_to.csv",
+	"group_by_contract.csv",
+	"chunk_heatmaps.csv",
+	"chunk_heatmaps.html",
+}
+
+// TestGoldenOutputs runs the full pipeline over the corpus in testdata/traces, and compares the
+// generated files with the ones in testdata/golden. Run with -update to regenerate them.
+func TestGoldenOutputs(t *testing.T) {
+	tracesPath, err := filepath.Abs("testdata/traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goldenPath, err := filepath.Abs("testdata/golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pcTracePaths, contractBytecodes, err := loadData(tracesPath, -1)
+	if err != nil {
+		t.Fatalf("loading data: %s", err)
+	}
+	filterContractsChunksStats := map[common.Address]struct{}{
+		common.HexToAddress("0xc0de01"): {},
+		common.HexToAddress("0xc0de02"): {},
+	}
+	layouts := []analysis.CodeKeyLayout{analysis.DefaultCodeKeyLayout, analysis.NewSeparateStemsLayout()}
+	reports := reportOptions{
+		groupBy:  groupByKeys,
+		labels:   map[common.Address]string{common.HexToAddress("0xc0de01"): "Router"},
+		heatmaps: true,
+	}
+
+	// A tiny memory budget processes the traces one at a time, and spills the aggregations to
+	// disk, which must generate the same files.
+	for _, maxMemory := range []int64{0, 4 << 10} {
+		t.Run(fmt.Sprintf("max-memory=%d", maxMemory), func(t *testing.T) {
+			out := outputFiles{dir: t.TempDir()}
+			progress := newProgressTracker(len(pcTracePaths), 1, 0)
+			if err := runAnalysis(context.Background(), pcTracePaths, contractBytecodes, filterContractsChunksStats, layouts, true, reports, maxMemory, progress, out); err != nil {
+				t.Fatalf("running analysis: %s", err)
+			}
+
+			for _, name := range goldenFiles {
+				output, err := os.ReadFile(out.path(name))
+				if err != nil {
+					t.Fatalf("reading output: %s", err)
+				}
+				goldenFilePath := filepath.Join(goldenPath, name)
+				if *update && maxMemory == 0 {
+					if err := os.WriteFile(goldenFilePath, output, 0644); err != nil {
+						t.Fatalf("updating golden file: %s", err)
+					}
+					continue
+				}
+				golden, err := os.ReadFile(goldenFilePath)
+				if err != nil {
+					t.Fatalf("reading golden file: %s", err)
+				}
+				if got, expected := string(output), string(golden); got != expected {
+					t.Errorf("%s doesn't match the golden file:\n%s", name, diffLines(expected, got))
+				}
+			}
+		})
+	}
+}
+
+// TestDisasmGolden disassembles the destination of a trace in testdata/traces, and compares it
+// with testdata/golden/disasm.txt. Run with -update to regenerate it.
+func TestDisasmGolden(t *testing.T) {
+	trace, err := pipeline.ReadTrace("testdata/traces/0x000000000000000000000000000000000000000000000000000000000007a000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := loadContractBytecode("testdata/traces", trace.To)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execCounts := countExecutions(code, trace.ContractsPCs[trace.To])
+
+	var output bytes.Buffer
+	if err := disassemble(&output, trace.To, code, analysis.DefaultCodeKeyLayout, execCounts); err != nil {
+		t.Fatalf("disassemble: %s", err)
+	}
+	goldenFilePath := filepath.Join("testdata", "golden", "disasm.txt")
+	if *update {
+		if err := os.WriteFile(goldenFilePath, output.Bytes(), 0644); err != nil {
+			t.Fatalf("updating golden file: %s", err)
+		}
+		return
+	}
+	golden, err := os.ReadFile(goldenFilePath)
+	if err != nil {
+		t.Fatalf("reading golden file: %s", err)
+	}
+	if got, expected := output.String(), string(golden); got != expected {
+		t.Errorf("disassembly doesn't match the golden file:\n%s", diffLines(expected, got))
+	}
+}
+
+// diffLines returns the lines that are only in one of expected or got.
+func diffLines(expected, got string) string {
+	expectedLines := strings.Split(expected, "\n")
+	gotLines := strings.Split(got, "\n")
+	var diff strings.Builder
+	for _, line := range expectedLines {
+		if !slices.Contains(gotLines, line) {
+			diff.WriteString("- " + line + "\n")
+		}
+	}
+	for _, line := range gotLines {
+		if !slices.Contains(expectedLines, line) {
+			diff.WriteString("+ " + line + "\n")
+		}
+	}
+	return diff.String()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	runStatusRunning   = "running"
+	runStatusCompleted = "completed"
+	runStatusFailed    = "failed"
+	// runStatusIncomplete is the status of runs that were interrupted, whose files only cover
+	// part of the traces.
+	runStatusIncomplete = "incomplete"
+)
+
+// outputFiles resolves the paths of the generated files of a run.
+type outputFiles struct {
+	dir    string
+	runID  string
+	format string
+}
+
+func (o outputFiles) path(name string) string {
+	if o.runID != "" {
+		name = o.runID + "_" + name
+	}
+	return filepath.Join(o.dir, name)
+}
+
+func (o outputFiles) create(name string) (*os.File, error) {
+	f, err := os.OpenFile(o.path(name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not create file: %s", err)
+	}
+	return f, nil
+}
+
+// runManifest describes how the files of a run were produced, and is saved next to them.
+type runManifest struct {
+	RunID      string `json:"run_id,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	TracesPath string `json:"traces_path"`
+	NumTraces  int    `json:"num_traces"`
+	// FailedTraces is the number of traces that failed to be processed.
+	FailedTraces int               `json:"failed_traces"`
+	Chunkers     []string          `json:"chunkers"`
+	Flags        map[string]string `json:"flags"`
+	GethVersion  string            `json:"geth_version"`
+	StartedAt    time.Time         `json:"started_at"`
+	FinishedAt   *time.Time        `json:"finished_at,omitempty"`
+}
+
+func newRunManifest(flags *flag.FlagSet, out outputFiles, tracesPath string, numTraces int, chunkerNames []string) *runManifest {
+	m := &runManifest{
+		RunID:       out.runID,
+		Status:      runStatusRunning,
+		TracesPath:  tracesPath,
+		NumTraces:   numTraces,
+		Chunkers:    chunkerNames,
+		Flags:       map[string]string{},
+		GethVersion: gethVersion(),
+		StartedAt:   time.Now().UTC(),
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		m.Flags[f.Name] = f.Value.String()
+	})
+	return m
+}
+
+// finish records the end of the run with failedTraces, which failed if err isn't nil, or is
+// incomplete if it was interrupted.
+func (m *runManifest) finish(err error, failedTraces int) {
+	finishedAt := time.Now().UTC()
+	m.FinishedAt = &finishedAt
+	m.FailedTraces = failedTraces
+	m.Status = runStatusCompleted
+	if err != nil {
+		m.Status = runStatusFailed
+		if errors.Is(err, errInterrupted) {
+			m.Status = runStatusIncomplete
+		}
+		m.Error = err.Error()
+	}
+}
+
+func (m *runManifest) write(out outputFiles) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode manifest: %s", err)
+	}
+	if err := os.WriteFile(out.path("run.json"), append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("could not write manifest: %s", err)
+	}
+	return nil
+}
+
+// gethVersion returns the version of the go-ethereum fork the tool was built with.
+func gethVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != "github.com/ethereum/go-ethereum" {
+			continue
+		}
+		if dep.Replace != nil {
+			return dep.Replace.Path + "@" + dep.Replace.Version
+		}
+		return dep.Path + "@" + dep.Version
+	}
+	return "unknown"
+}
+
+// readRunManifest reads the manifest of a previous run.
+func readRunManifest(out outputFiles) (*runManifest, error) {
+	b, err := os.ReadFile(out.path("run.json"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest: %s", err)
+	}
+	var m runManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("could not decode manifest: %s", err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	formatCSV     = "csv"
+	formatParquet = "parquet"
+	formatJSONL   = "jsonl"
+	// formatSQLite writes all the results into a single database instead of a file per table.
+	formatSQLite = "sqlite"
+
+	// parquetRowGroupSize is the maximum number of rows buffered before flushing a row group.
+	parquetRowGroupSize = 128 * 1024
+)
+
+// tableFormats are the formats that write every table into its own file.
+var tableFormats = []string{formatCSV, formatParquet, formatJSONL}
+
+var outputFormats = append(slices.Clone(tableFormats), formatSQLite)
+
+// readableFormats are the table formats that can be read back, e.g. to diff runs.
+var readableFormats = []string{formatCSV, formatJSONL}
+
+type columnKind int
+
+const (
+	columnString columnKind = iota
+	columnInt
+	columnUint
+	columnAddress
+	columnHash
+	columnFloat
+)
+
+// column is a typed column of a table. Rows values must have the Go type of their column kind:
+// string, int, uint64, common.Address, common.Hash or float64.
+type column struct {
+	name string
+	kind columnKind
+}
+
+// tableWriter writes the rows of a table in some output format.
+type tableWriter interface {
+	Write(row []any) error
+	// Close flushes any buffered rows, and closes the underlying file.
+	Close() error
+}
+
+// createTable creates the file of a table in the configured output format.
+func (o outputFiles) createTable(name string, columns []column) (tableWriter, error) {
+	format := o.format
+	if format == "" {
+		format = formatCSV
+	}
+	f, err := o.create(name + "." + format)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case formatCSV:
+		return newCSVTableWriter(f, columns)
+	case formatParquet:
+		return newParquetTableWriter(f, columns), nil
+	case formatJSONL:
+		return newJSONLTableWriter(f, columns), nil
+	default:
+		f.Close()
+		return nil, fmt.Errorf("unknown output format %s", format)
+	}
+}
+
+type csvTableWriter struct {
+	f *os.File
+	w *csv.Writer
+
+	line []string
+}
+
+func newCSVTableWriter(f *os.File, columns []column) (*csvTableWriter, error) {
+	w := csv.NewWriter(f)
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c.name
+	}
+	if err := w.Write(header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not write csv header: %s", err)
+	}
+	return &csvTableWriter{f: f, w: w, line: make([]string, len(columns))}, nil
+}
+
+func (t *csvTableWriter) Write(row []any) error {
+	for i, v := range row {
+		switch v := v.(type) {
+		case string:
+			t.line[i] = v
+		case int:
+			t.line[i] = strconv.Itoa(v)
+		case uint64:
+			t.line[i] = strconv.FormatUint(v, 10)
+		case common.Address:
+			t.line[i] = v.Hex()
+		case common.Hash:
+			t.line[i] = v.Hex()
+		case float64:
+			t.line[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("unsupported value type %T", v)
+		}
+	}
+	if err := t.w.Write(t.line); err != nil {
+		return fmt.Errorf("could not write csv line: %s", err)
+	}
+	return nil
+}
+
+func (t *csvTableWriter) Close() error {
+	t.w.Flush()
+	if err := t.w.Error(); err != nil {
+		t.f.Close()
+		return fmt.Errorf("could not flush csv: %s", err)
+	}
+	return t.f.Close()
+}
+
+type parquetTableWriter struct {
+	f *os.File
+	w *parquet.Writer
+
+	// columnIndexes maps the columns of the table to the (sorted by name) schema columns.
+	columnIndexes []int
+	columnKinds   []columnKind
+	row           parquet.Row
+}
+
+func newParquetTableWriter(f *os.File, columns []column) *parquetTableWriter {
+	group := parquet.Group{}
+	for _, c := range columns {
+		switch c.kind {
+		case columnString:
+			group[c.name] = parquet.String()
+		case columnInt:
+			group[c.name] = parquet.Int(64)
+		case columnUint:
+			group[c.name] = parquet.Uint(64)
+		case columnAddress:
+			group[c.name] = parquet.Leaf(parquet.FixedLenByteArrayType(common.AddressLength))
+		case columnHash:
+			group[c.name] = parquet.Leaf(parquet.FixedLenByteArrayType(common.HashLength))
+		case columnFloat:
+			group[c.name] = parquet.Leaf(parquet.DoubleType)
+		}
+	}
+	schema := parquet.NewSchema("table", group)
+	schemaIndexes := map[string]int{}
+	for i, field := range schema.Fields() {
+		schemaIndexes[field.Name()] = i
+	}
+
+	t := &parquetTableWriter{
+		f: f,
+		w: parquet.NewWriter(f, schema,
+			parquet.Compression(&parquet.Zstd),
+			parquet.MaxRowsPerRowGroup(parquetRowGroupSize)),
+		columnIndexes: make([]int, len(columns)),
+		columnKinds:   make([]columnKind, len(columns)),
+		row:           make(parquet.Row, len(columns)),
+	}
+	for i, c := range columns {
+		t.columnIndexes[i] = schemaIndexes[c.name]
+		t.columnKinds[i] = c.kind
+	}
+	return t
+}
+
+func (t *parquetTableWriter) Write(row []any) error {
+	for i, v := range row {
+		var value parquet.Value
+		switch v := v.(type) {
+		case string:
+			value = parquet.ByteArrayValue([]byte(v))
+		case int:
+			value = parquet.Int64Value(int64(v))
+		case uint64:
+			value = parquet.Int64Value(int64(v))
+		case common.Address:
+			value = parquet.FixedLenByteArrayValue(v.Bytes())
+		case common.Hash:
+			value = parquet.FixedLenByteArrayValue(v.Bytes())
+		case float64:
+			value = parquet.DoubleValue(v)
+		default:
+			return fmt.Errorf("unsupported value type %T", v)
+		}
+		idx := t.columnIndexes[i]
+		t.row[idx] = value.Level(0, 0, idx)
+	}
+	if _, err := t.w.WriteRows([]parquet.Row{t.row}); err != nil {
+		return fmt.Errorf("could not write parquet row: %s", err)
+	}
+	return nil
+}
+
+func (t *parquetTableWriter) Close() error {
+	if err := t.w.Close(); err != nil {
+		t.f.Close()
+		return fmt.Errorf("could not close parquet writer: %s", err)
+	}
+	return t.f.Close()
+}
+
+type jsonlTableWriter struct {
+	f *os.File
+	w *bufio.Writer
+
+	// keys are the JSON-encoded column names.
+	keys [][]byte
+}
+
+func newJSONLTableWriter(f *os.File, columns []column) *jsonlTableWriter {
+	t := &jsonlTableWriter{f: f, w: bufio.NewWriter(f), keys: make([][]byte, len(columns))}
+	for i, c := range columns {
+		t.keys[i], _ = json.Marshal(c.name)
+	}
+	return t
+}
+
+func (t *jsonlTableWriter) Write(row []any) error {
+	var line []byte
+	for i, v := range row {
+		if i == 0 {
+			line = append(line, '{')
+		} else {
+			line = append(line, ',')
+		}
+		line = append(line, t.keys[i]...)
+		line = append(line, ':')
+		switch v := v.(type) {
+		case string:
+			value, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("could not encode value: %s", err)
+			}
+			line = append(line, value...)
+		case int:
+			line = strconv.AppendInt(line, int64(v), 10)
+		case uint64:
+			line = strconv.AppendUint(line, v, 10)
+		case common.Address:
+			line = strconv.AppendQuote(line, v.Hex())
+		case common.Hash:
+			line = strconv.AppendQuote(line, v.Hex())
+		case float64:
+			line = strconv.AppendFloat(line, v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("unsupported value type %T", v)
+		}
+	}
+	line = append(line, '}', '\n')
+	if _, err := t.w.Write(line); err != nil {
+		return fmt.Errorf("could not write jsonl line: %s", err)
+	}
+	return nil
+}
+
+func (t *jsonlTableWriter) Close() error {
+	if err := t.w.Flush(); err != nil {
+		t.f.Close()
+		return fmt.Errorf("could not flush jsonl: %s", err)
+	}
+	return t.f.Close()
+}
+
+// tableReader reads back the rows of a table generated by a tableWriter, with the values
+// formatted as in CSV.
+type tableReader interface {
+	// Read returns the next row by column name, or io.EOF after the last one.
+	Read() (map[string]string, error)
+	Close() error
+}
+
+// openTable opens the file of a table in the configured output format, one of readableFormats.
+func (o outputFiles) openTable(name string) (tableReader, error) {
+	format := o.format
+	if format == "" {
+		format = formatCSV
+	}
+	if !slices.Contains(readableFormats, format) {
+		return nil, fmt.Errorf("reading %s tables isn't supported", format)
+	}
+	f, err := os.Open(o.path(name + "." + format))
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %s", err)
+	}
+	switch format {
+	case formatCSV:
+		r := csv.NewReader(bufio.NewReader(f))
+		header, err := r.Read()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not read csv header: %s", err)
+		}
+		return &csvTableReader{f: f, r: r, header: header}, nil
+	default:
+		d := json.NewDecoder(bufio.NewReader(f))
+		d.UseNumber()
+		return &jsonlTableReader{f: f, d: d}, nil
+	}
+}
+
+type csvTableReader struct {
+	f      *os.File
+	r      *csv.Reader
+	header []string
+}
+
+func (t *csvTableReader) Read() (map[string]string, error) {
+	record, err := t.r.Read()
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read csv line: %s", err)
+	}
+	row := make(map[string]string, len(record))
+	for i, v := range record {
+		row[t.header[i]] = v
+	}
+	return row, nil
+}
+
+func (t *csvTableReader) Close() error {
+	return t.f.Close()
+}
+
+type jsonlTableReader struct {
+	f *os.File
+	d *json.Decoder
+}
+
+func (t *jsonlTableReader) Read() (map[string]string, error) {
+	var line map[string]any
+	if err := t.d.Decode(&line); err == io.EOF {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read jsonl line: %s", err)
+	}
+	row := make(map[string]string, len(line))
+	for k, v := range line {
+		row[k] = fmt.Sprint(v)
+	}
+	return row, nil
+}
+
+func (t *jsonlTableReader) Close() error {
+	return t.f.Close()
+}
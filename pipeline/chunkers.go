@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/analysis/z31bytechunker"
+	"github.com/jsign/verkle-chunking-analysis/analysis/z32bytebitmapchunker"
+	"github.com/jsign/verkle-chunking-analysis/analysis/z32bytechunker"
+)
+
+// NewChunkers returns a new instance of every chunker running under each of the layouts. The
+// 32-byte chunkers storing the JUMPDEST analysis as per-chunk bitmaps are only included if
+// bitmaps is set, since they're meant to compare the encodings rather than for every run.
+func NewChunkers(layouts []analysis.CodeKeyLayout, bitmaps bool) []analysis.Chunker {
+	chunkers := make([]analysis.Chunker, 0, 5*len(layouts))
+	for _, layout := range layouts {
+		chunkers = append(chunkers,
+			z31bytechunker.New(layout),
+			z32bytechunker.New(layout, false),
+			z32bytechunker.New(layout, true))
+		if bitmaps {
+			chunkers = append(chunkers,
+				z32bytebitmapchunker.New(layout, z32bytebitmapchunker.PushdataBitmap),
+				z32bytebitmapchunker.New(layout, z32bytebitmapchunker.FalseJumpdestBitset))
+		}
+	}
+	return chunkers
+}
+
+// ChunkerNames returns the names of the chunkers returned by NewChunkers.
+func ChunkerNames(layouts []analysis.CodeKeyLayout, bitmaps bool) []string {
+	return names(NewChunkers(layouts, bitmaps))
+}
+
+func names(chunkers []analysis.Chunker) []string {
+	var names []string
+	for _, ch := range chunkers {
+		names = append(names, ch.Name())
+	}
+	return names
+}
+
+// RunChunkers runs every chunker over the executed PCs of the contracts, and returns their reports.
+func RunChunkers(
+	chunkers []analysis.Chunker,
+	contractsPCs map[common.Address][]uint64,
+	contractBytecodes map[common.Address][]byte,
+	enableChunksStats bool) ([]analysis.ChunkerMetrics, error) {
+	// Contracts are executed in a fixed order, since the chunk that gets charged for a shared
+	// tree branch depends on it.
+	touchedContracts := SortedAddresses(contractsPCs)
+
+	metrics := make([]analysis.ChunkerMetrics, 0, len(chunkers))
+	for _, ch := range chunkers {
+		if err := ch.Init(touchedContracts, contractBytecodes, enableChunksStats); err != nil {
+			return nil, fmt.Errorf("error creating chunker: %s", err)
+		}
+		for _, contractAddr := range touchedContracts {
+			for _, pc := range contractsPCs[contractAddr] {
+				if err := ch.AccessPC(contractAddr, pc); err != nil {
+					return nil, fmt.Errorf("error accessing pc: %s", err)
+				}
+			}
+		}
+		metrics = append(metrics, ch.GetReport())
+	}
+	return metrics, nil
+}
+
+// SortedAddresses returns the keys of the map in ascending order.
+func SortedAddresses[T any](m map[common.Address]T) []common.Address {
+	addrs := make([]common.Address, 0, len(m))
+	for addr := range m {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return bytes.Compare(addrs[i][:], addrs[j][:]) < 0 })
+	return addrs
+}
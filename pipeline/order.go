@@ -0,0 +1,43 @@
+package pipeline
+
+// Indexed is an item of an ordered input, tagged with its position so the results can be put
+// back in order after being processed concurrently.
+type Indexed[T any] struct {
+	Index int
+	Item  T
+}
+
+// QueueInOrder returns a closed channel with all the items, to be consumed by a pool of workers.
+func QueueInOrder[T any](items []T) <-chan Indexed[T] {
+	queue := make(chan Indexed[T], len(items))
+	for i, item := range items {
+		queue <- Indexed[T]{Index: i, Item: item}
+	}
+	close(queue)
+	return queue
+}
+
+// ReorderBuffer emits results in the order of their index, holding back the ones that arrive
+// before some of their predecessors. Since workers take items in order, it only holds a few.
+type ReorderBuffer[T any] struct {
+	next    int
+	pending map[int]T
+}
+
+func (b *ReorderBuffer[T]) Push(index int, result T, emit func(T) error) error {
+	if b.pending == nil {
+		b.pending = map[int]T{}
+	}
+	b.pending[index] = result
+	for {
+		result, ok := b.pending[b.next]
+		if !ok {
+			return nil
+		}
+		delete(b.pending, b.next)
+		b.next++
+		if err := emit(result); err != nil {
+			return err
+		}
+	}
+}
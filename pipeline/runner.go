@@ -0,0 +1,337 @@
+// Package pipeline runs the chunkers over folders of PC traces, so the analysis can be embedded
+// in other tools.
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// sinkBufferSize is the number of results a sink can fall behind the others.
+	sinkBufferSize = 1_000
+	// traceMemoryFactor estimates the memory taken by a trace in flight from the size of its
+	// file. The gob encoding takes 1 to 3 bytes per PC, which take 8 bytes once decoded, and the
+	// result keeps the stats of the executed contracts of every chunker.
+	traceMemoryFactor = 8
+	// chunkStatsMemoryFactor estimates the memory of the chunks stats of a trace from the size of
+	// its file, for every chunker. Each PC takes at least a byte, and is assumed to touch a new
+	// chunk, whose stats take 24 bytes.
+	chunkStatsMemoryFactor = 24
+)
+
+// Result is the outcome of running the chunkers over a trace.
+type Result struct {
+	// Index is the position of the trace in the input.
+	Index int
+
+	Tx               string
+	ExecLength       int
+	ReceiptGas       uint64
+	To               common.Address
+	NumExecContracts int
+	ChunkersMetrics  []analysis.ChunkerMetrics
+	// ChunksStatsFiltered is true if the tx destination is one of the contracts to export the
+	// chunks stats of.
+	ChunksStatsFiltered bool
+
+	// Worker is the processor that produced the result, which spent ProcessingTime on it.
+	Worker         int
+	ProcessingTime time.Duration
+	TraceBytes     int
+}
+
+// TraceError is returned when a trace can't be processed.
+type TraceError struct {
+	Path string
+	Err  error
+}
+
+func (e *TraceError) Error() string {
+	return fmt.Sprintf("error processing %s: %s", e.Path, e.Err)
+}
+
+func (e *TraceError) Unwrap() error {
+	return e.Err
+}
+
+// Sink consumes the results of a run in the order of the traces, until the channel is closed.
+type Sink func(results <-chan Result) error
+
+// Options configures a Runner.
+type Options struct {
+	// TracePaths are the trace files to process, and ContractBytecodes the code of the contracts
+	// they execute. Both can be loaded from a traces folder with LoadData.
+	TracePaths        []string
+	ContractBytecodes map[common.Address][]byte
+
+	// Chunkers returns a new instance of the chunkers to run, since every worker needs its own.
+	// By default, the chunkers of NewChunkers run under the EIP-6800 code key layout.
+	Chunkers func() []analysis.Chunker
+	// Workers is the number of traces processed concurrently, runtime.NumCPU() by default.
+	Workers int
+	// MaxInFlightBytes bounds the estimated memory of the traces being processed, or waiting to
+	// be consumed by the sinks, including their chunks stats if they're collected. New traces are
+	// only read when there's room for them. It's unbounded if zero. The memory the sinks keep is
+	// bounded by them.
+	MaxInFlightBytes int64
+
+	// ChunksStatsContracts are the tx destinations to collect the chunks stats of, or all of
+	// them if AllChunksStats is set.
+	ChunksStatsContracts map[common.Address]struct{}
+	AllChunksStats       bool
+
+	// Sinks consume the results in the order of the traces.
+	Sinks []Sink
+	// OnResult is called with every result as soon as its trace is processed, in no particular
+	// order, e.g: to track the progress of the run.
+	OnResult func(Result)
+	// OnTraceError is called with every trace that fails to be processed. The run stops on the
+	// first one, but other workers can fail on their traces before stopping.
+	OnTraceError func(*TraceError)
+	// OnDone is called once the traces are processed, or the run stops with err, before waiting
+	// for the sinks to finish.
+	OnDone func(err error)
+}
+
+// Runner processes the traces with a pool of workers, and streams the results to the sinks.
+type Runner struct {
+	opts Options
+}
+
+// NewRunner creates a Runner, filling the defaults of the options.
+func NewRunner(opts Options) *Runner {
+	if opts.Chunkers == nil {
+		opts.Chunkers = func() []analysis.Chunker {
+			return NewChunkers([]analysis.CodeKeyLayout{analysis.DefaultCodeKeyLayout}, false)
+		}
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	return &Runner{opts: opts}
+}
+
+// ChunkerNames returns the names of the chunkers, in the order of the ChunkersMetrics of the results.
+func (r *Runner) ChunkerNames() []string {
+	return names(r.opts.Chunkers())
+}
+
+// inFlight is a result on its way to the sinks, which pendingSinks didn't get yet.
+type inFlight struct {
+	result       Result
+	pendingSinks *atomic.Int32
+}
+
+// processed is the outcome of a worker processing a trace.
+type processed struct {
+	result Result
+	err    error
+}
+
+// Run processes all the traces and waits for the sinks to consume the results. If the context
+// is canceled, the sinks get the results emitted until then, and the context error is returned.
+func (r *Runner) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var budget *semaphore.Weighted
+	weights := make([]int64, len(r.opts.TracePaths))
+	traces := QueueInOrder(r.opts.TracePaths)
+	if r.opts.MaxInFlightBytes > 0 {
+		budget = semaphore.NewWeighted(r.opts.MaxInFlightBytes)
+		traces = r.admitInOrder(ctx, budget, weights, r.memoryFactor())
+	}
+	processorResults := make(chan processed)
+	for i := 0; i < r.opts.Workers; i++ {
+		go r.processFiles(ctx, traces, i, processorResults)
+	}
+
+	// Every sink receives the results from a forwarder, which releases the memory of a result
+	// once all the sinks got it.
+	fanout := make([]chan inFlight, len(r.opts.Sinks))
+	group, groupCtx := errgroup.WithContext(context.Background())
+	for i, sink := range r.opts.Sinks {
+		fanout[i] = make(chan inFlight, sinkBufferSize)
+		queued, results := fanout[i], make(chan Result)
+		group.Go(func() error { return sink(results) })
+		group.Go(func() error {
+			defer close(results)
+			for f := range queued {
+				select {
+				case results <- f.result:
+				case <-groupCtx.Done():
+				}
+				if f.pendingSinks.Add(-1) == 0 && budget != nil {
+					budget.Release(weights[f.result.Index])
+				}
+			}
+			return nil
+		})
+	}
+	emit := func(result Result) error {
+		f := inFlight{result: result, pendingSinks: &atomic.Int32{}}
+		f.pendingSinks.Store(int32(len(fanout)))
+		if len(fanout) == 0 && budget != nil {
+			budget.Release(weights[result.Index])
+		}
+		for i := range fanout {
+			select {
+			case fanout[i] <- f:
+			case <-groupCtx.Done():
+				return groupCtx.Err()
+			}
+		}
+		return nil
+	}
+
+	runErr := r.streamInOrder(ctx, processorResults, emit)
+	cancel()
+	if r.opts.OnDone != nil {
+		r.opts.OnDone(runErr)
+	}
+	for i := range fanout {
+		close(fanout[i])
+	}
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("error exporting results: %s", err)
+	}
+	return runErr
+}
+
+// streamInOrder receives the results of the workers, and emits them in the order of the traces,
+// so runs over the same input generate the same files.
+func (r *Runner) streamInOrder(ctx context.Context, processorResults <-chan processed, emit func(Result) error) error {
+	var ordered ReorderBuffer[Result]
+	for i := 0; i < len(r.opts.TracePaths); i++ {
+		// Checked first, since select picks randomly when results are also ready.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case p := <-processorResults:
+			if p.err != nil {
+				return p.err
+			}
+			if r.opts.OnResult != nil {
+				r.opts.OnResult(p.result)
+			}
+			if err := ordered.Push(p.result.Index, p.result, emit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// memoryFactor estimates the memory of a trace in flight from the size of its file. If chunks
+// stats are collected, they're counted for every trace, since its destination isn't known until
+// it's read.
+func (r *Runner) memoryFactor() int64 {
+	factor := int64(traceMemoryFactor)
+	if r.opts.AllChunksStats || len(r.opts.ChunksStatsContracts) > 0 {
+		factor += chunkStatsMemoryFactor * int64(len(r.opts.Chunkers()))
+	}
+	return factor
+}
+
+// admitInOrder queues the traces as the budget has room for their estimated memory, recording
+// the weight of every trace to release it once consumed. Traces are admitted in order, so the next
+// one to emit always got its share, and the ones held back waiting for it can't starve it.
+func (r *Runner) admitInOrder(ctx context.Context, budget *semaphore.Weighted, weights []int64, memoryFactor int64) <-chan Indexed[string] {
+	queue := make(chan Indexed[string], r.opts.Workers)
+	go func() {
+		defer close(queue)
+		for i, pcTracePath := range r.opts.TracePaths {
+			// Traces larger than the budget are processed alone. If the file can't be read,
+			// processing it fails right away.
+			weights[i] = 1
+			if info, err := os.Stat(pcTracePath); err == nil {
+				weights[i] = min(max(info.Size()*memoryFactor, 1), r.opts.MaxInFlightBytes)
+			}
+			if err := budget.Acquire(ctx, weights[i]); err != nil {
+				return
+			}
+			select {
+			case queue <- Indexed[string]{Index: i, Item: pcTracePath}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return queue
+}
+
+func (r *Runner) processFiles(ctx context.Context, traces <-chan Indexed[string], worker int, out chan<- processed) {
+	chunkers := r.opts.Chunkers()
+
+	for trace := range traces {
+		res, err := r.processFile(chunkers, trace, worker)
+		if err != nil {
+			traceErr := &TraceError{Path: trace.Item, Err: err}
+			if r.opts.OnTraceError != nil {
+				r.opts.OnTraceError(traceErr)
+			}
+			err = traceErr
+		}
+		select {
+		case out <- processed{result: res, err: err}:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *Runner) processFile(chunkers []analysis.Chunker, trace Indexed[string], worker int) (Result, error) {
+	start := time.Now()
+	pcTracePath := trace.Item
+	pcTraceBytes, err := os.ReadFile(pcTracePath)
+	if err != nil {
+		return Result{}, fmt.Errorf("error reading file: %w", err)
+	}
+	txOutput, err := DecodeTrace(pcTraceBytes)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var traceLength int
+	for _, pcs := range txOutput.ContractsPCs {
+		traceLength += len(pcs)
+	}
+	_, txHash := path.Split(pcTracePath)
+	res := Result{
+		Index:            trace.Index,
+		Tx:               txHash,
+		To:               txOutput.To,
+		ExecLength:       traceLength,
+		ReceiptGas:       txOutput.ReceiptGas,
+		NumExecContracts: len(txOutput.ContractsPCs),
+		Worker:           worker,
+		TraceBytes:       len(pcTraceBytes),
+	}
+
+	_, res.ChunksStatsFiltered = r.opts.ChunksStatsContracts[txOutput.To]
+	enableChunksStats := res.ChunksStatsFiltered || r.opts.AllChunksStats
+	res.ChunkersMetrics, err = RunChunkers(chunkers, txOutput.ContractsPCs, r.opts.ContractBytecodes, enableChunksStats)
+	if err != nil {
+		return Result{}, err
+	}
+
+	res.ProcessingTime = time.Since(start)
+	return res, nil
+}
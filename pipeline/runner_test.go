@@ -0,0 +1,153 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunnerEmitsInOrder(t *testing.T) {
+	pcTracePaths, contractBytecodes, err := LoadData("../testdata/traces", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A budget of a single byte processes the traces one at a time.
+	for _, maxInFlightBytes := range []int64{0, 1} {
+		var onResultCalls atomic.Int32
+		sinks := make([][]Result, 2)
+		runner := NewRunner(Options{
+			TracePaths:        pcTracePaths,
+			ContractBytecodes: contractBytecodes,
+			Workers:           4,
+			MaxInFlightBytes:  maxInFlightBytes,
+			Sinks: []Sink{
+				func(results <-chan Result) error {
+					for result := range results {
+						sinks[0] = append(sinks[0], result)
+					}
+					return nil
+				},
+				func(results <-chan Result) error {
+					for result := range results {
+						sinks[1] = append(sinks[1], result)
+					}
+					return nil
+				},
+			},
+			OnResult: func(Result) { onResultCalls.Add(1) },
+		})
+		if err := runner.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := int(onResultCalls.Load()); got != len(pcTracePaths) {
+			t.Fatalf("expected %d OnResult calls, got %d", len(pcTracePaths), got)
+		}
+		for _, results := range sinks {
+			if len(results) != len(pcTracePaths) {
+				t.Fatalf("expected %d results, got %d", len(pcTracePaths), len(results))
+			}
+			for i, result := range results {
+				if result.Index != i || result.Tx != filepath.Base(pcTracePaths[i]) {
+					t.Fatalf("expected result %d to be %s, got %d %s", i, filepath.Base(pcTracePaths[i]), result.Index, result.Tx)
+				}
+				if len(result.ChunkersMetrics) != len(runner.ChunkerNames()) {
+					t.Fatalf("expected %d chunkers metrics, got %d", len(runner.ChunkerNames()), len(result.ChunkersMetrics))
+				}
+			}
+		}
+	}
+}
+
+func TestRunnerTraceError(t *testing.T) {
+	badTracePath := filepath.Join(t.TempDir(), "0x01")
+	if err := os.WriteFile(badTracePath, []byte("not a trace"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var failedPaths []string
+	runner := NewRunner(Options{
+		TracePaths:   []string{badTracePath},
+		OnTraceError: func(err *TraceError) { failedPaths = append(failedPaths, err.Path) },
+	})
+	err := runner.Run(context.Background())
+	var traceErr *TraceError
+	if !errors.As(err, &traceErr) || traceErr.Path != badTracePath {
+		t.Fatalf("expected a trace error for %s, got %v", badTracePath, err)
+	}
+	if len(failedPaths) != 1 || failedPaths[0] != badTracePath {
+		t.Fatalf("expected OnTraceError to be called with %s, got %v", badTracePath, failedPaths)
+	}
+}
+
+func TestRunnerCanceled(t *testing.T) {
+	pcTracePaths, contractBytecodes, err := LoadData("../testdata/traces", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var consumed int
+	runner := NewRunner(Options{
+		TracePaths:        pcTracePaths,
+		ContractBytecodes: contractBytecodes,
+		Workers:           1,
+		Sinks: []Sink{func(results <-chan Result) error {
+			for range results {
+				consumed++
+			}
+			return nil
+		}},
+		OnResult: func(Result) { cancel() },
+	})
+	if err := runner.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the run to be canceled, got %v", err)
+	}
+	if consumed == 0 || consumed == len(pcTracePaths) {
+		t.Fatalf("expected the sink to get some of the %d results, got %d", len(pcTracePaths), consumed)
+	}
+}
+
+func TestChunkStatsMemoryFactor(t *testing.T) {
+	pcTracePaths, contractBytecodes, err := LoadData("../testdata/traces", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []Result
+	runner := NewRunner(Options{
+		TracePaths:        pcTracePaths,
+		ContractBytecodes: contractBytecodes,
+		AllChunksStats:    true,
+		Sinks: []Sink{func(rs <-chan Result) error {
+			for result := range rs {
+				results = append(results, result)
+			}
+			return nil
+		}},
+	})
+	if err := runner.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	numChunkers := int64(len(runner.ChunkerNames()))
+	if factor := runner.memoryFactor(); factor != traceMemoryFactor+chunkStatsMemoryFactor*numChunkers {
+		t.Fatalf("expected the memory factor to count the chunks stats of %d chunkers, got %d", numChunkers, factor)
+	}
+	for _, result := range results {
+		var chunksStats int64
+		for _, cm := range result.ChunkersMetrics {
+			for _, stats := range cm.ContractsStats {
+				chunksStats += int64(len(stats.ChunksStats))
+			}
+		}
+		if estimate := int64(result.TraceBytes) * chunkStatsMemoryFactor * numChunkers; chunksStats*24 > estimate {
+			t.Fatalf("%s: %d chunks stats take more than the estimated %d bytes", result.Tx, chunksStats, estimate)
+		}
+	}
+	if factor := NewRunner(Options{}).memoryFactor(); factor != traceMemoryFactor {
+		t.Fatalf("expected the memory factor without chunks stats to be %d, got %d", traceMemoryFactor, factor)
+	}
+}
@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"golang.org/x/sync/errgroup"
+)
+
+// Trace is the PC trace of a tx, as written by the live tracer.
+type Trace struct {
+	ContractsPCs map[common.Address][]uint64
+	ReceiptGas   uint64
+	To           common.Address
+}
+
+// ReadTrace reads and decodes a PC trace file.
+func ReadTrace(pcTracePath string) (Trace, error) {
+	pcTraceBytes, err := os.ReadFile(pcTracePath)
+	if err != nil {
+		return Trace{}, fmt.Errorf("error reading file: %w", err)
+	}
+	return DecodeTrace(pcTraceBytes)
+}
+
+// DecodeTrace decodes the content of a PC trace file.
+func DecodeTrace(pcTraceBytes []byte) (Trace, error) {
+	var trace Trace
+	if err := gob.NewDecoder(bytes.NewReader(pcTraceBytes)).Decode(&trace); err != nil {
+		return Trace{}, fmt.Errorf("error decoding file: %w", err)
+	}
+	return trace, nil
+}
+
+// LoadData returns the paths of the trace files in the folder, up to limit of them if it isn't -1,
+// and the bytecodes of the contracts in its code subfolder. Trace files are named after the hash
+// of their tx, which the generated files key txs by, so other files are skipped and logged.
+func LoadData(folderPath string, limit int) ([]string, map[common.Address][]byte, error) {
+	dirEntries, err := os.ReadDir(folderPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read directory %s: %w", folderPath, err)
+	}
+	pcTracesPaths := make([]string, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			continue
+		}
+		if limit != -1 && len(pcTracesPaths) >= limit {
+			break
+		}
+		if !isTxHash(dirEntry.Name()) {
+			log.Printf("Skipping %s, its name isn't a tx hash", path.Join(folderPath, dirEntry.Name()))
+			continue
+		}
+		pcTracesPaths = append(pcTracesPaths, path.Join(folderPath, dirEntry.Name()))
+	}
+
+	contractBytecodes, err := LoadContractBytecodes(folderPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pcTracesPaths, contractBytecodes, nil
+}
+
+func isTxHash(name string) bool {
+	hash, err := hexutil.Decode(name)
+	return err == nil && len(hash) == common.HashLength
+}
+
+// LoadContractBytecodes returns the bytecodes of the contracts in the code subfolder of the folder.
+func LoadContractBytecodes(folderPath string) (map[common.Address][]byte, error) {
+	dirEntries, err := os.ReadDir(path.Join(folderPath, "code"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory %s: %w", path.Join(folderPath, "code"), err)
+	}
+
+	var lock sync.Mutex
+	group, _ := errgroup.WithContext(context.Background())
+	group.SetLimit(runtime.NumCPU())
+	contractBytecodes := map[common.Address][]byte{}
+	for _, dirEntry := range dirEntries {
+		dirEntry := dirEntry
+		group.Go(func() error {
+			bytecode, err := os.ReadFile(path.Join(folderPath, "code", dirEntry.Name()))
+			if err != nil {
+				return fmt.Errorf("could not read file %s: %w", path.Join(folderPath, dirEntry.Name()), err)
+			}
+			lock.Lock()
+			contractBytecodes[common.HexToAddress(dirEntry.Name())] = bytecode
+			lock.Unlock()
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, fmt.Errorf("error loading contract bytecodes: %s", err)
+	}
+
+	return contractBytecodes, nil
+}
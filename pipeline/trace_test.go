@@ -0,0 +1,28 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadDataSkipsNonTxHashNames(t *testing.T) {
+	tracesPath := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tracesPath, "code"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	txHash := "0x" + strings.Repeat("01", 32)
+	for _, name := range []string{txHash, ".DS_Store", "README", "0x01", "0x" + strings.Repeat("0g", 32), "0x" + strings.Repeat("01", 33)} {
+		if err := os.WriteFile(filepath.Join(tracesPath, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pcTracePaths, _, err := LoadData(tracesPath, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pcTracePaths) != 1 || filepath.Base(pcTracePaths[0]) != txHash {
+		t.Fatalf("expected only the trace of tx %s, got %v", txHash, pcTracePaths)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "verkle_chunking"
+
+	defaultProgressInterval = 10 * time.Second
+)
+
+// progressTracker tracks the processing of the traces of a run, and logs it periodically.
+type progressTracker struct {
+	total       int
+	workers     int
+	logInterval time.Duration
+	start       time.Time
+	stop        chan struct{}
+
+	mu         sync.Mutex
+	processed  int
+	bytes      uint64
+	workerBusy []time.Duration
+	// failedTraces is the number of traces that couldn't be processed. The run stops on the
+	// first one, but the other workers can fail too before stopping.
+	failedTraces int
+}
+
+// progress is a snapshot of the progress of a run.
+type progress struct {
+	Total        int     `json:"total"`
+	Processed    int     `json:"processed"`
+	FailedTraces int     `json:"failed_traces"`
+	Bytes        uint64  `json:"bytes"`
+	ElapsedSecs  float64 `json:"elapsed_secs"`
+	TracesPerSec float64 `json:"traces_per_sec"`
+	BytesPerSec  float64 `json:"bytes_per_sec"`
+	// ETASecs is the estimated time left, or -1 before any trace is processed.
+	ETASecs float64 `json:"eta_secs"`
+	// WorkersUtilization is the fraction of the elapsed time every worker spent processing traces.
+	WorkersUtilization []float64 `json:"workers_utilization"`
+}
+
+// newProgressTracker creates a tracker of total traces processed by workers, which logs the
+// progress every logInterval if it isn't zero.
+func newProgressTracker(total, workers int, logInterval time.Duration) *progressTracker {
+	return &progressTracker{
+		total:       total,
+		workers:     workers,
+		logInterval: logInterval,
+		workerBusy:  make([]time.Duration, workers),
+	}
+}
+
+// begin starts the clock of the run, and the periodic log.
+func (p *progressTracker) begin() {
+	p.mu.Lock()
+	p.start = time.Now()
+	p.mu.Unlock()
+	if p.logInterval <= 0 {
+		return
+	}
+	p.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(p.logInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Println(p.snapshot().logLine())
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// end stops the periodic log, and logs the final progress of the run.
+func (p *progressTracker) end(error) {
+	if p.stop != nil {
+		close(p.stop)
+	}
+	fmt.Println(p.snapshot().logLine())
+}
+
+func (p *progressTracker) record(result pipeline.Result) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processed++
+	p.bytes += uint64(result.TraceBytes)
+	if result.Worker < len(p.workerBusy) {
+		p.workerBusy[result.Worker] += result.ProcessingTime
+	}
+}
+
+func (p *progressTracker) recordError(*pipeline.TraceError) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failedTraces++
+}
+
+func (p *progressTracker) snapshot() progress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := progress{
+		Total:              p.total,
+		Processed:          p.processed,
+		FailedTraces:       p.failedTraces,
+		Bytes:              p.bytes,
+		ETASecs:            -1,
+		WorkersUtilization: make([]float64, len(p.workerBusy)),
+	}
+	if p.start.IsZero() {
+		return s
+	}
+	elapsed := time.Since(p.start)
+	s.ElapsedSecs = elapsed.Seconds()
+	if s.ElapsedSecs > 0 {
+		s.TracesPerSec = float64(p.processed) / s.ElapsedSecs
+		s.BytesPerSec = float64(p.bytes) / s.ElapsedSecs
+		for i, busy := range p.workerBusy {
+			s.WorkersUtilization[i] = min(1, busy.Seconds()/s.ElapsedSecs)
+		}
+	}
+	if s.TracesPerSec > 0 {
+		s.ETASecs = float64(p.total-p.processed) / s.TracesPerSec
+	}
+	return s
+}
+
+func (s progress) logLine() string {
+	var sb strings.Builder
+	percent := 100.0
+	if s.Total > 0 {
+		percent = float64(s.Processed) * 100 / float64(s.Total)
+	}
+	fmt.Fprintf(&sb, "Processing traces... %.0f%% (%d/%d), %.1f traces/s, %.1f MB/s", percent, s.Processed, s.Total, s.TracesPerSec, s.BytesPerSec/1e6)
+	if s.ETASecs >= 0 {
+		fmt.Fprintf(&sb, ", ETA %s", (time.Duration(s.ETASecs) * time.Second).String())
+	}
+	var utilization float64
+	for _, u := range s.WorkersUtilization {
+		utilization += u
+	}
+	if len(s.WorkersUtilization) > 0 {
+		utilization /= float64(len(s.WorkersUtilization))
+	}
+	fmt.Fprintf(&sb, ", workers %.0f%% busy", utilization*100)
+	fmt.Fprintf(&sb, ", %d failed", s.FailedTraces)
+	return sb.String()
+}
+
+var (
+	tracesDesc          = prometheus.NewDesc(metricsNamespace+"_traces", "Number of traces of the run.", nil, nil)
+	tracesProcessedDesc = prometheus.NewDesc(metricsNamespace+"_traces_processed_total", "Number of processed traces.", nil, nil)
+	failedTracesDesc    = prometheus.NewDesc(metricsNamespace+"_failed_traces_total", "Number of traces that failed to be processed.", nil, nil)
+	traceBytesDesc      = prometheus.NewDesc(metricsNamespace+"_trace_bytes_processed_total", "Size of the processed traces.", nil, nil)
+	tracesPerSecDesc    = prometheus.NewDesc(metricsNamespace+"_traces_per_second", "Average number of traces processed per second.", nil, nil)
+	bytesPerSecDesc     = prometheus.NewDesc(metricsNamespace+"_trace_bytes_per_second", "Average size of the traces processed per second.", nil, nil)
+	etaDesc             = prometheus.NewDesc(metricsNamespace+"_eta_seconds", "Estimated time left to process all the traces.", nil, nil)
+	workerUtilDesc      = prometheus.NewDesc(metricsNamespace+"_worker_utilization", "Fraction of the elapsed time a worker spent processing traces.", []string{"worker"}, nil)
+)
+
+func (p *progressTracker) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{tracesDesc, tracesProcessedDesc, failedTracesDesc, traceBytesDesc, tracesPerSecDesc, bytesPerSecDesc, etaDesc, workerUtilDesc} {
+		ch <- desc
+	}
+}
+
+func (p *progressTracker) Collect(ch chan<- prometheus.Metric) {
+	s := p.snapshot()
+	ch <- prometheus.MustNewConstMetric(tracesDesc, prometheus.GaugeValue, float64(s.Total))
+	ch <- prometheus.MustNewConstMetric(tracesProcessedDesc, prometheus.CounterValue, float64(s.Processed))
+	ch <- prometheus.MustNewConstMetric(failedTracesDesc, prometheus.CounterValue, float64(s.FailedTraces))
+	ch <- prometheus.MustNewConstMetric(traceBytesDesc, prometheus.CounterValue, float64(s.Bytes))
+	ch <- prometheus.MustNewConstMetric(tracesPerSecDesc, prometheus.GaugeValue, s.TracesPerSec)
+	ch <- prometheus.MustNewConstMetric(bytesPerSecDesc, prometheus.GaugeValue, s.BytesPerSec)
+	ch <- prometheus.MustNewConstMetric(etaDesc, prometheus.GaugeValue, s.ETASecs)
+	for i, u := range s.WorkersUtilization {
+		ch <- prometheus.MustNewConstMetric(workerUtilDesc, prometheus.GaugeValue, u, strconv.Itoa(i))
+	}
+}
+
+// serveMetrics serves the progress in Prometheus format on /metrics, and as JSON on /progress.
+func serveMetrics(addr string, p *progressTracker) error {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(p); err != nil {
+		return fmt.Errorf("could not register metrics: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/progress", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.snapshot())
+	})
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %s", addr, err)
+	}
+	fmt.Printf("Serving metrics on http://%s/metrics\n", listener.Addr())
+	go http.Serve(listener, mux)
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis"
+	"github.com/jsign/verkle-chunking-analysis/analysis/eof"
+	"github.com/jsign/verkle-chunking-analysis/analysis/z32bytechunker"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+	"golang.org/x/sync/errgroup"
+)
+
+// sizesBatchSize is the number of contracts chunkified by every set of chunkers, which bounds
+// the size of their access witnesses.
+const sizesBatchSize = 1_000
+
+type contractSizes struct {
+	originalSize      int
+	pushdataJumpdests int
+	// chunkersStats are the stats of the contract in every chunker.
+	chunkersStats []analysis.ContractStats
+	// stems is the number of stems holding the chunked code in every chunker.
+	stems []int
+}
+
+// runSizes chunkifies every contract in the code corpus under every chunker, independently of
+// the traces that touch them.
+func runSizes(args []string) error {
+	flags := flag.NewFlagSet("sizes", flag.ExitOnError)
+	pcTraceFolderFlag := flags.String("tracespath", "", "Full path of the folder containing the traces")
+	codeLayoutsFlag := flags.String("code-layouts", "eip6800", "Comma separated list of code key layouts to run every chunker under (eip6800, separatestems, codehash, header<N>).")
+	bitmapChunkersFlag := flags.Bool("bitmap-chunkers", false, bitmapChunkersUsage)
+	outFlag := flags.String("out", ".", "Folder where the generated files are written")
+	runIDFlag := flags.String("run-id", "", "Prefix for the names of the generated files, to keep the results of different runs apart")
+	formatFlag := flags.String("format", formatCSV, fmt.Sprintf("Format of the generated table (%s)", strings.Join(tableFormats, "|")))
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *pcTraceFolderFlag == "" {
+		return fmt.Errorf("expected --tracespath <folder> flag")
+	}
+	layouts, err := parseCodeKeyLayouts(*codeLayoutsFlag)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(tableFormats, *formatFlag) {
+		return fmt.Errorf("unsupported output format %s", *formatFlag)
+	}
+	out := outputFiles{dir: *outFlag, runID: *runIDFlag, format: *formatFlag}
+	if err := os.MkdirAll(out.dir, 0755); err != nil {
+		return fmt.Errorf("could not create output folder: %s", err)
+	}
+
+	contractBytecodes, err := loadContractBytecodes(*pcTraceFolderFlag)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Chunkifying contracts... ")
+	contracts := pipeline.SortedAddresses(contractBytecodes)
+	sizes := make([]contractSizes, len(contracts))
+	group, _ := errgroup.WithContext(context.Background())
+	group.SetLimit(runtime.NumCPU())
+	for start := 0; start < len(contracts); start += sizesBatchSize {
+		start, end := start, min(start+sizesBatchSize, len(contracts))
+		group.Go(func() error {
+			batchSizes, err := chunkifyContracts(contracts[start:end], contractBytecodes, layouts, *bitmapChunkersFlag)
+			if err != nil {
+				return err
+			}
+			copy(sizes[start:end], batchSizes)
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("error chunkifying contracts: %s", err)
+	}
+	fmt.Printf("OK\n")
+
+	names := pipeline.ChunkerNames(layouts, *bitmapChunkersFlag)
+	if err := genContractsSizesTable(contracts, sizes, names, out); err != nil {
+		return fmt.Errorf("error exporting contracts sizes table: %s", err)
+	}
+
+	var totalOriginalSize int
+	totalChunkedSizes := make([]int, len(names))
+	for _, s := range sizes {
+		totalOriginalSize += s.originalSize
+		for i, stats := range s.chunkersStats {
+			totalChunkedSizes[i] += stats.ChunkedSizeBytes
+		}
+	}
+	fmt.Printf("Chunkified %d contracts with %d bytes of code\n", len(contracts), totalOriginalSize)
+	for i, name := range names {
+		fmt.Printf("%s: %d bytes (%.2f%% overhead)\n", name, totalChunkedSizes[i],
+			percentage(int64(totalChunkedSizes[i]-totalOriginalSize), uint64(totalOriginalSize)))
+	}
+	return nil
+}
+
+// chunkifyContracts returns the sizes of the contracts under every chunker running under each layout.
+func chunkifyContracts(contracts []common.Address, contractBytecodes map[common.Address][]byte, layouts []analysis.CodeKeyLayout, bitmapChunkers bool) ([]contractSizes, error) {
+	sizes := make([]contractSizes, len(contracts))
+	for i, addr := range contracts {
+		code := contractBytecodes[addr]
+		sizes[i].originalSize = len(code)
+		if _, err := eof.Parse(code); err != nil {
+			sizes[i].pushdataJumpdests = len(z32bytechunker.InvalidJumpdests(code))
+		}
+	}
+	for _, layout := range layouts {
+		for _, ch := range pipeline.NewChunkers([]analysis.CodeKeyLayout{layout}, bitmapChunkers) {
+			if err := ch.Init(contracts, contractBytecodes, false); err != nil {
+				return nil, fmt.Errorf("error creating chunker: %s", err)
+			}
+			report := ch.GetReport()
+			for i, addr := range contracts {
+				stats := report.ContractsStats[addr]
+				sizes[i].chunkersStats = append(sizes[i].chunkersStats, stats)
+				sizes[i].stems = append(sizes[i].stems, analysis.NumStems(layout, uint64(stats.ChunkedSizeBytes/32)))
+			}
+		}
+	}
+	return sizes, nil
+}
+
+func genContractsSizesTable(contracts []common.Address, sizes []contractSizes, chunkerNames []string, out outputFiles) (err error) {
+	columns := []column{
+		{name: "contract_addr", kind: columnAddress},
+		{name: "original_size", kind: columnInt},
+		{name: "pushdata_jumpdests", kind: columnInt},
+	}
+	for _, cn := range chunkerNames {
+		columns = append(columns, column{name: fmt.Sprintf("%s_chunked_size", cn), kind: columnInt})
+	}
+	for _, cn := range chunkerNames {
+		columns = append(columns, column{name: fmt.Sprintf("%s_table_size", cn), kind: columnInt})
+	}
+	for _, cn := range chunkerNames {
+		columns = append(columns, column{name: fmt.Sprintf("%s_stems", cn), kind: columnInt})
+	}
+	sizesTable, err := out.createTable("contracts_sizes", columns)
+	if err != nil {
+		return err
+	}
+	defer closeTable(sizesTable, &err)
+
+	for i, addr := range contracts {
+		row := []any{addr, sizes[i].originalSize, sizes[i].pushdataJumpdests}
+		for _, cs := range sizes[i].chunkersStats {
+			row = append(row, cs.ChunkedSizeBytes)
+		}
+		for _, cs := range sizes[i].chunkersStats {
+			row = append(row, cs.TableSizeBytes)
+		}
+		for _, stems := range sizes[i].stems {
+			row = append(row, stems)
+		}
+		if err := sizesTable.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
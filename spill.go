@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// spillSorter aggregates values by key, and returns them in key order. When their estimated
+// memory goes over maxBytes, they're written sorted to a run file and merged back at the end, so
+// the aggregation of all the contracts of mainnet fits in the memory budget.
+type spillSorter[K comparable, V any] struct {
+	// parentDir is where the run files are written. It's the output folder, since the system
+	// temporary folder may be backed by memory.
+	parentDir string
+	maxBytes  int64
+	compare   func(a, b K) int
+	// size estimates the memory of a value, including its key and the map overhead.
+	size func(value V) int64
+	// combine merges the values of a key aggregated in different txs or runs.
+	combine func(a, b V) V
+
+	entries map[K]V
+	bytes   int64
+	dir     string
+	runs    []string
+}
+
+// spilledEntry is a record of a run file.
+type spilledEntry[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+// newSpillSorter creates a sorter that spills to parentDir once its values take maxBytes, or
+// never if it's 0.
+func newSpillSorter[K comparable, V any](parentDir string, maxBytes int64, compare func(a, b K) int, size func(V) int64, combine func(a, b V) V) *spillSorter[K, V] {
+	return &spillSorter[K, V]{
+		parentDir: parentDir,
+		maxBytes:  maxBytes,
+		compare:   compare,
+		size:      size,
+		combine:   combine,
+		entries:   map[K]V{},
+	}
+}
+
+// splitMemory splits a memory budget in parts of at least a byte, so they're still bounded, or
+// returns 0 if the budget is unbounded.
+func splitMemory(budget int64, parts int) int64 {
+	if budget <= 0 {
+		return 0
+	}
+	return max(1, budget/int64(parts))
+}
+
+// compareAddresses orders addresses as pipeline.SortedAddresses does.
+func compareAddresses(a, b common.Address) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func (s *spillSorter[K, V]) add(key K, value V) error {
+	if prev, ok := s.entries[key]; ok {
+		s.bytes -= s.size(prev)
+		value = s.combine(prev, value)
+	}
+	s.entries[key] = value
+	s.bytes += s.size(value)
+	if s.maxBytes > 0 && s.bytes >= s.maxBytes {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *spillSorter[K, V]) sortedKeys() []K {
+	keys := make([]K, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, s.compare)
+	return keys
+}
+
+func (s *spillSorter[K, V]) spill() error {
+	if s.dir == "" {
+		dir, err := os.MkdirTemp(s.parentDir, ".spill-")
+		if err != nil {
+			return fmt.Errorf("could not create spill folder: %s", err)
+		}
+		s.dir = dir
+	}
+	runPath := filepath.Join(s.dir, fmt.Sprintf("run-%d", len(s.runs)))
+	f, err := os.Create(runPath)
+	if err != nil {
+		return fmt.Errorf("could not create spill file: %s", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	for _, key := range s.sortedKeys() {
+		if err := enc.Encode(spilledEntry[K, V]{Key: key, Value: s.entries[key]}); err != nil {
+			return fmt.Errorf("could not write spill file: %s", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("could not write spill file: %s", err)
+	}
+	s.runs = append(s.runs, runPath)
+	s.entries = map[K]V{}
+	s.bytes = 0
+	return nil
+}
+
+// each calls fn with the aggregated value of every key, in ascending order.
+func (s *spillSorter[K, V]) each(fn func(key K, value V) error) error {
+	memory := s.sortedKeys()
+	heads := make([]*spilledEntry[K, V], len(s.runs)+1)
+	next := make([]func() (*spilledEntry[K, V], error), len(s.runs)+1)
+	next[0] = func() (*spilledEntry[K, V], error) {
+		if len(memory) == 0 {
+			return nil, nil
+		}
+		entry := &spilledEntry[K, V]{Key: memory[0], Value: s.entries[memory[0]]}
+		memory = memory[1:]
+		return entry, nil
+	}
+	for i, runPath := range s.runs {
+		f, err := os.Open(runPath)
+		if err != nil {
+			return fmt.Errorf("could not open spill file: %s", err)
+		}
+		defer f.Close()
+		dec := gob.NewDecoder(bufio.NewReader(f))
+		next[i+1] = func() (*spilledEntry[K, V], error) {
+			var entry spilledEntry[K, V]
+			if err := dec.Decode(&entry); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil, nil
+				}
+				return nil, fmt.Errorf("could not read spill file: %s", err)
+			}
+			return &entry, nil
+		}
+	}
+	for i := range heads {
+		var err error
+		if heads[i], err = next[i](); err != nil {
+			return err
+		}
+	}
+
+	// Runs are few, so the smallest key is looked up in all of them.
+	for {
+		var smallest *K
+		for _, head := range heads {
+			if head != nil && (smallest == nil || s.compare(head.Key, *smallest) < 0) {
+				smallest = &head.Key
+			}
+		}
+		if smallest == nil {
+			return nil
+		}
+		key := *smallest
+		var value V
+		var found bool
+		for i, head := range heads {
+			if head == nil || head.Key != key {
+				continue
+			}
+			if found {
+				value = s.combine(value, head.Value)
+			} else {
+				value, found = head.Value, true
+			}
+			var err error
+			if heads[i], err = next[i](); err != nil {
+				return err
+			}
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+}
+
+// close removes the run files.
+func (s *spillSorter[K, V]) close() error {
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.RemoveAll(s.dir); err != nil {
+		return fmt.Errorf("could not remove spill folder: %s", err)
+	}
+	return nil
+}
+
+// closeSpillSorter removes the run files of the sorter, setting err if it's nil and that fails.
+func closeSpillSorter[K comparable, V any](s *spillSorter[K, V], err *error) {
+	if closeErr := s.close(); closeErr != nil && *err == nil {
+		*err = closeErr
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestSpillSorter(t *testing.T) {
+	dir := t.TempDir()
+	// Every value takes a byte, so the sorter spills every 2 addresses.
+	sorter := newSpillSorter(dir, 2, compareAddresses, func(int) int64 { return 1 }, func(a, b int) int { return a + b })
+	for _, addr := range []string{"0x05", "0x03", "0x01", "0x03", "0x04", "0x01", "0x02"} {
+		if err := sorter.add(common.HexToAddress(addr), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sorter.runs) == 0 {
+		t.Fatalf("expected the sorter to spill")
+	}
+
+	var addrs []common.Address
+	var values []int
+	err := sorter.each(func(addr common.Address, value int) error {
+		addrs = append(addrs, addr)
+		values = append(values, value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedAddrs := []common.Address{
+		common.HexToAddress("0x01"),
+		common.HexToAddress("0x02"),
+		common.HexToAddress("0x03"),
+		common.HexToAddress("0x04"),
+		common.HexToAddress("0x05"),
+	}
+	if !reflect.DeepEqual(addrs, expectedAddrs) || !reflect.DeepEqual(values, []int{2, 1, 2, 1, 1}) {
+		t.Fatalf("expected %v with values [2 1 2 1 1], got %v with values %v", expectedAddrs, addrs, values)
+	}
+
+	if err := sorter.close(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("expected the spill files to be removed, got %v (%v)", entries, err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteTxBatchSize is the number of traces whose results are inserted in a single database transaction.
+const sqliteTxBatchSize = 1_000
+
+// sqliteSchema is the normalized schema of the results database. Hashes and addresses are stored
+// hex encoded as in the other output formats, so they can be copied between them.
+var sqliteSchema = []string{
+	`CREATE TABLE chunkers (
+		id   INTEGER PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE
+	)`,
+	`CREATE TABLE transactions (
+		tx                 TEXT PRIMARY KEY,
+		to_addr            TEXT NOT NULL,
+		execution_length   INTEGER NOT NULL,
+		receipt_gas        INTEGER NOT NULL,
+		num_exec_contracts INTEGER NOT NULL
+	)`,
+	`CREATE TABLE contracts (
+		contract_addr TEXT PRIMARY KEY,
+		original_size INTEGER NOT NULL
+	)`,
+	`CREATE TABLE chunker_results (
+		tx           TEXT NOT NULL REFERENCES transactions (tx),
+		chunker_id   INTEGER NOT NULL REFERENCES chunkers (id),
+		gas          INTEGER NOT NULL,
+		branch_gas   INTEGER NOT NULL,
+		table_chunks INTEGER NOT NULL,
+		PRIMARY KEY (tx, chunker_id)
+	)`,
+	`CREATE TABLE contract_chunked_sizes (
+		contract_addr TEXT NOT NULL REFERENCES contracts (contract_addr),
+		chunker_id    INTEGER NOT NULL REFERENCES chunkers (id),
+		chunked_size  INTEGER NOT NULL,
+		table_size    INTEGER NOT NULL,
+		PRIMARY KEY (contract_addr, chunker_id)
+	)`,
+	`CREATE TABLE chunk_stats (
+		tx            TEXT NOT NULL REFERENCES transactions (tx),
+		contract_addr TEXT NOT NULL REFERENCES contracts (contract_addr),
+		chunker_id    INTEGER NOT NULL REFERENCES chunkers (id),
+		chunk_number  INTEGER NOT NULL,
+		bytes_used    INTEGER NOT NULL,
+		gas_used      INTEGER NOT NULL
+	)`,
+	`CREATE INDEX transactions_to_addr ON transactions (to_addr)`,
+	`CREATE INDEX chunker_results_chunker ON chunker_results (chunker_id)`,
+	`CREATE INDEX contract_chunked_sizes_chunker ON contract_chunked_sizes (chunker_id)`,
+	`CREATE INDEX chunk_stats_tx ON chunk_stats (tx)`,
+	`CREATE INDEX chunk_stats_contract ON chunk_stats (contract_addr)`,
+	`CREATE INDEX chunk_stats_chunker ON chunk_stats (chunker_id)`,
+
+	// top_gas_overhead_txs lists the code access gas of every tx and chunker relative to the gas
+	// paid by the tx, the most affected ones first.
+	`CREATE VIEW top_gas_overhead_txs AS
+		SELECT t.tx, t.to_addr, c.name AS chunker, r.gas, t.receipt_gas,
+			100.0 * r.gas / t.receipt_gas AS overhead_pct
+		FROM chunker_results r
+		JOIN transactions t ON t.tx = r.tx
+		JOIN chunkers c ON c.id = r.chunker_id
+		WHERE t.receipt_gas > 0
+		ORDER BY overhead_pct DESC`,
+	// contract_chunk_utilization summarizes how much of the accessed chunks of every contract is used.
+	`CREATE VIEW contract_chunk_utilization AS
+		SELECT s.contract_addr, c.name AS chunker,
+			COUNT(DISTINCT s.tx) AS num_txs,
+			COUNT(*) AS chunk_accesses,
+			COUNT(DISTINCT s.chunk_number) AS distinct_chunks,
+			cs.chunked_size / 32 AS total_chunks,
+			AVG(s.bytes_used) AS avg_bytes_used,
+			SUM(s.gas_used) AS gas_used
+		FROM chunk_stats s
+		JOIN chunkers c ON c.id = s.chunker_id
+		LEFT JOIN contract_chunked_sizes cs ON cs.contract_addr = s.contract_addr AND cs.chunker_id = s.chunker_id
+		GROUP BY s.contract_addr, s.chunker_id`,
+	// chunker_totals aggregates the results of every chunker over all the txs.
+	`CREATE VIEW chunker_totals AS
+		SELECT c.name AS chunker,
+			COUNT(*) AS num_txs,
+			SUM(r.gas) AS gas,
+			SUM(r.branch_gas) AS branch_gas,
+			SUM(r.table_chunks) AS table_chunks,
+			SUM(t.receipt_gas) AS receipt_gas,
+			100.0 * SUM(r.gas) / SUM(t.receipt_gas) AS overhead_pct
+		FROM chunker_results r
+		JOIN transactions t ON t.tx = r.tx
+		JOIN chunkers c ON c.id = r.chunker_id
+		GROUP BY r.chunker_id
+		ORDER BY r.chunker_id`,
+}
+
+// seenContractBytes estimates the memory of a seen contract, including the map overhead.
+const seenContractBytes = 64
+
+// genSQLiteStore writes the results into the results.db SQLite database. The contracts whose
+// sizes were inserted are remembered within aggregationMemory, unless it's 0.
+func genSQLiteStore(results <-chan pipeline.Result, chunkerNames []string, contractBytecodes map[common.Address][]byte, aggregationMemory int64, out outputFiles) (err error) {
+	dbPath := out.path("results.db")
+	if err := os.Remove(dbPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove previous database: %s", err)
+	}
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return fmt.Errorf("could not open database: %s", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("could not close database: %s", closeErr)
+		}
+	}()
+	// Results are written by a single goroutine, and a single connection avoids locking errors.
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("could not create schema: %s", err)
+		}
+	}
+	for id, name := range chunkerNames {
+		if _, err := db.Exec("INSERT INTO chunkers (id, name) VALUES (?, ?)", id, name); err != nil {
+			return fmt.Errorf("could not insert chunker: %s", err)
+		}
+	}
+
+	w := &sqliteWriter{
+		db:               db,
+		seenContracts:    map[common.Address]struct{}{},
+		maxSeenContracts: int(splitMemory(aggregationMemory, seenContractBytes)),
+	}
+	defer func() {
+		if w.tx != nil {
+			w.tx.Rollback()
+		}
+	}()
+	var pending int
+	for result := range results {
+		if w.tx == nil {
+			if err := w.begin(); err != nil {
+				return err
+			}
+		}
+		if err := w.insert(result, contractBytecodes); err != nil {
+			return err
+		}
+		if pending++; pending == sqliteTxBatchSize {
+			if err := w.commit(); err != nil {
+				return err
+			}
+			pending = 0
+		}
+	}
+	if w.tx != nil {
+		return w.commit()
+	}
+	return nil
+}
+
+// sqliteWriter inserts results in batches, using prepared statements of the current transaction.
+type sqliteWriter struct {
+	db *sql.DB
+	tx *sql.Tx
+
+	insertTx          *sql.Stmt
+	insertContract    *sql.Stmt
+	insertResult      *sql.Stmt
+	insertChunkedSize *sql.Stmt
+	insertChunkStats  *sql.Stmt
+
+	// seenContracts are the contracts whose sizes were already inserted, so they aren't inserted
+	// again. It's only a cache, which is cleared once it has maxSeenContracts if it isn't 0, since
+	// inserting them again is ignored.
+	seenContracts    map[common.Address]struct{}
+	maxSeenContracts int
+}
+
+func (w *sqliteWriter) begin() error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin database transaction: %s", err)
+	}
+	w.tx = tx
+	stmts := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&w.insertTx, "INSERT INTO transactions (tx, to_addr, execution_length, receipt_gas, num_exec_contracts) VALUES (?, ?, ?, ?, ?)"},
+		{&w.insertContract, "INSERT OR IGNORE INTO contracts (contract_addr, original_size) VALUES (?, ?)"},
+		{&w.insertResult, "INSERT INTO chunker_results (tx, chunker_id, gas, branch_gas, table_chunks) VALUES (?, ?, ?, ?, ?)"},
+		{&w.insertChunkedSize, "INSERT OR IGNORE INTO contract_chunked_sizes (contract_addr, chunker_id, chunked_size, table_size) VALUES (?, ?, ?, ?)"},
+		{&w.insertChunkStats, "INSERT INTO chunk_stats (tx, contract_addr, chunker_id, chunk_number, bytes_used, gas_used) VALUES (?, ?, ?, ?, ?, ?)"},
+	}
+	for _, s := range stmts {
+		if *s.stmt, err = tx.Prepare(s.query); err != nil {
+			return fmt.Errorf("could not prepare statement: %s", err)
+		}
+	}
+	return nil
+}
+
+func (w *sqliteWriter) commit() error {
+	err := w.tx.Commit()
+	w.tx = nil
+	if err != nil {
+		return fmt.Errorf("could not commit database transaction: %s", err)
+	}
+	return nil
+}
+
+func (w *sqliteWriter) insert(result pipeline.Result, contractBytecodes map[common.Address][]byte) error {
+	txHash := common.HexToHash(result.Tx).Hex()
+	if _, err := w.insertTx.Exec(txHash, result.To.Hex(), result.ExecLength, result.ReceiptGas, result.NumExecContracts); err != nil {
+		return fmt.Errorf("could not insert transaction: %s", err)
+	}
+	for chunkerID, cm := range result.ChunkersMetrics {
+		if _, err := w.insertResult.Exec(txHash, chunkerID, cm.Gas, cm.BranchGas, cm.TableChunksTouched); err != nil {
+			return fmt.Errorf("could not insert chunker result: %s", err)
+		}
+		for _, contractAddr := range pipeline.SortedAddresses(cm.ContractsStats) {
+			stats := cm.ContractsStats[contractAddr]
+			addr := contractAddr.Hex()
+			if _, ok := w.seenContracts[contractAddr]; !ok {
+				if _, err := w.insertContract.Exec(addr, len(contractBytecodes[contractAddr])); err != nil {
+					return fmt.Errorf("could not insert contract: %s", err)
+				}
+				if _, err := w.insertChunkedSize.Exec(addr, chunkerID, stats.ChunkedSizeBytes, stats.TableSizeBytes); err != nil {
+					return fmt.Errorf("could not insert contract chunked size: %s", err)
+				}
+			}
+			if !result.ChunksStatsFiltered {
+				continue
+			}
+			for _, chunkStats := range stats.ChunksStats {
+				if _, err := w.insertChunkStats.Exec(txHash, addr, chunkerID, chunkStats.ChunkNumber, chunkStats.AccessedBytes, chunkStats.ChargedGas); err != nil {
+					return fmt.Errorf("could not insert chunk stats: %s", err)
+				}
+			}
+		}
+	}
+	// Contracts are marked as seen once the sizes for every chunker were inserted.
+	if w.maxSeenContracts > 0 && len(w.seenContracts) >= w.maxSeenContracts {
+		w.seenContracts = map[common.Address]struct{}{}
+	}
+	for _, cm := range result.ChunkersMetrics {
+		for contractAddr := range cm.ContractsStats {
+			w.seenContracts[contractAddr] = struct{}{}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+// sketchGamma is the ratio between the bounds of consecutive quantile sketch buckets, so
+// estimated quantiles are within 1% of the real ones.
+const sketchGamma = 1.02
+
+// txOverheadBounds are the upper bounds of the histogram buckets of the per-tx code gas
+// overhead, as a percentage of the receipt gas.
+var txOverheadBounds = []float64{1, 2, 5, 10, 20, 50, 100}
+
+// quantileSketch estimates quantiles of a stream of non-negative values with a bounded relative
+// error, by counting them in exponentially sized buckets.
+type quantileSketch struct {
+	zeros   uint64
+	buckets map[int]uint64
+	count   uint64
+}
+
+func (s *quantileSketch) add(v float64) {
+	s.count++
+	if v <= 0 {
+		s.zeros++
+		return
+	}
+	if s.buckets == nil {
+		s.buckets = map[int]uint64{}
+	}
+	s.buckets[int(math.Ceil(math.Log(v)/math.Log(sketchGamma)))]++
+}
+
+func (s *quantileSketch) quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(s.count-1))
+	if rank < s.zeros {
+		return 0
+	}
+	indexes := make([]int, 0, len(s.buckets))
+	for i := range s.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	seen := s.zeros
+	for _, i := range indexes {
+		seen += s.buckets[i]
+		if rank < seen {
+			// Values in bucket i are in (gamma^(i-1), gamma^i].
+			return 2 * math.Pow(sketchGamma, float64(i)) / (sketchGamma + 1)
+		}
+	}
+	return 0
+}
+
+type quantiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+func (s *quantileSketch) quantiles() quantiles {
+	return quantiles{P50: s.quantile(0.5), P90: s.quantile(0.9), P99: s.quantile(0.99)}
+}
+
+type histogramBucket struct {
+	// UpperBound is the inclusive upper bound of the bucket, or +Inf for the last one.
+	UpperBound string `json:"le"`
+	Count      uint64 `json:"count"`
+}
+
+type summaryReport struct {
+	NumTxs           int              `json:"num_txs"`
+	ReceiptGas       uint64           `json:"receipt_gas"`
+	NumContracts     int              `json:"num_contracts"`
+	OriginalCodeSize uint64           `json:"original_code_size"`
+	Chunkers         []chunkerSummary `json:"chunkers"`
+}
+
+type chunkerSummary struct {
+	Name         string `json:"name"`
+	Gas          uint64 `json:"gas"`
+	BranchGas    uint64 `json:"branch_gas"`
+	TableChunks  uint64 `json:"table_chunks"`
+	WitnessBytes uint64 `json:"witness_bytes"`
+	// CodeGasPct is the total code access gas as a percentage of the total receipt gas.
+	CodeGasPct      float64 `json:"code_gas_pct"`
+	ChunkedCodeSize uint64  `json:"chunked_code_size"`
+	SizeOverheadPct float64 `json:"size_overhead_pct"`
+	// Baseline is the 31-byte chunker running under the same layout, which the gas is compared to.
+	Baseline               string            `json:"baseline,omitempty"`
+	GasDiffVsBaseline      int64             `json:"gas_diff_vs_baseline"`
+	GasDiffVsBaselinePct   float64           `json:"gas_diff_vs_baseline_pct"`
+	TxGas                  quantiles         `json:"tx_gas"`
+	TxOverheadPct          quantiles         `json:"tx_overhead_pct"`
+	TxOverheadPctHistogram []histogramBucket `json:"tx_overhead_pct_histogram"`
+
+	// Streamed per-tx values, summarized in the fields above once all the txs are aggregated.
+	txGasSketch             quantileSketch
+	txOverheadPctSketch     quantileSketch
+	txOverheadPctHistCounts []uint64
+}
+
+// chunkedSizesBytes estimates the memory of the chunked sizes of a contract for every chunker,
+// including the address key and the map overhead.
+func chunkedSizesBytes(numChunkers int) int64 {
+	return int64(100 + 8*numChunkers)
+}
+
+// genSummary aggregates the results while they're streamed, and writes the summary report. The
+// chunked sizes of the executed contracts are aggregated within aggregationMemory, or spilled to
+// disk, unless it's 0.
+func genSummary(results <-chan pipeline.Result, chunkerNames []string, contractBytecodes map[common.Address][]byte, aggregationMemory int64, out outputFiles) (err error) {
+	report := summaryReport{Chunkers: make([]chunkerSummary, len(chunkerNames))}
+	for i, name := range chunkerNames {
+		report.Chunkers[i].Name = name
+		report.Chunkers[i].txOverheadPctHistCounts = make([]uint64, len(txOverheadBounds)+1)
+	}
+
+	// The chunked sizes of a contract are the same in every tx, so the first ones are kept.
+	contractsChunkedSizes := newSpillSorter(out.dir, aggregationMemory, compareAddresses,
+		func([]int) int64 { return chunkedSizesBytes(len(chunkerNames)) },
+		func(a, _ []int) []int { return a })
+	defer closeSpillSorter(contractsChunkedSizes, &err)
+	for result := range results {
+		report.NumTxs++
+		report.ReceiptGas += result.ReceiptGas
+		for i, cm := range result.ChunkersMetrics {
+			cs := &report.Chunkers[i]
+			cs.Gas += cm.Gas
+			cs.BranchGas += cm.BranchGas
+			cs.TableChunks += cm.TableChunksTouched
+			cs.WitnessBytes += cm.WitnessSizeBytes()
+			cs.txGasSketch.add(float64(cm.Gas))
+			if result.ReceiptGas > 0 {
+				overheadPct := float64(cm.Gas) * 100 / float64(result.ReceiptGas)
+				cs.txOverheadPctSketch.add(overheadPct)
+				cs.txOverheadPctHistCounts[sort.SearchFloat64s(txOverheadBounds, overheadPct)]++
+			}
+		}
+		if len(result.ChunkersMetrics) == 0 {
+			continue
+		}
+		for addr := range result.ChunkersMetrics[0].ContractsStats {
+			chunkedSizes := make([]int, len(chunkerNames))
+			for i, cm := range result.ChunkersMetrics {
+				chunkedSizes[i] = cm.ContractsStats[addr].ChunkedSizeBytes
+			}
+			if err := contractsChunkedSizes.add(addr, chunkedSizes); err != nil {
+				return err
+			}
+		}
+	}
+	err = contractsChunkedSizes.each(func(addr common.Address, chunkedSizes []int) error {
+		report.NumContracts++
+		report.OriginalCodeSize += uint64(len(contractBytecodes[addr]))
+		for i, size := range chunkedSizes {
+			report.Chunkers[i].ChunkedCodeSize += uint64(size)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Chunkers are created for every layout in order, starting with the 31-byte chunker.
+	baseline := 0
+	for i := range report.Chunkers {
+		cs := &report.Chunkers[i]
+		if strings.HasPrefix(cs.Name, "31bytechunker") {
+			baseline = i
+		} else {
+			cs.Baseline = report.Chunkers[baseline].Name
+			cs.GasDiffVsBaseline = int64(cs.Gas) - int64(report.Chunkers[baseline].Gas)
+			cs.GasDiffVsBaselinePct = percentage(cs.GasDiffVsBaseline, report.Chunkers[baseline].Gas)
+		}
+		cs.CodeGasPct = percentage(int64(cs.Gas), report.ReceiptGas)
+		cs.SizeOverheadPct = percentage(int64(cs.ChunkedCodeSize)-int64(report.OriginalCodeSize), report.OriginalCodeSize)
+		cs.TxGas = cs.txGasSketch.quantiles()
+		cs.TxOverheadPct = cs.txOverheadPctSketch.quantiles()
+		for j, count := range cs.txOverheadPctHistCounts {
+			upperBound := "+Inf"
+			if j < len(txOverheadBounds) {
+				upperBound = fmt.Sprint(txOverheadBounds[j])
+			}
+			cs.TxOverheadPctHistogram = append(cs.TxOverheadPctHistogram, histogramBucket{UpperBound: upperBound, Count: count})
+		}
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode summary: %s", err)
+	}
+	if err := os.WriteFile(out.path("summary.json"), append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("could not write summary: %s", err)
+	}
+	markdown := report.markdown()
+	if err := os.WriteFile(out.path("summary.md"), []byte(markdown), 0644); err != nil {
+		return fmt.Errorf("could not write summary: %s", err)
+	}
+	fmt.Print(markdown)
+	return nil
+}
+
+func (r summaryReport) markdown() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Summary\n\n")
+	fmt.Fprintf(&sb, "%d txs with %d receipt gas, executing %d contracts with %d bytes of code.\n\n",
+		r.NumTxs, r.ReceiptGas, r.NumContracts, r.OriginalCodeSize)
+
+	fmt.Fprintf(&sb, "## Gas\n\n")
+	fmt.Fprintf(&sb, "| Chunker | Gas | Branch gas | Witness bytes | Code gas / receipt gas | Diff vs baseline | Tx overhead p50 | p90 | p99 |\n")
+	fmt.Fprintf(&sb, "|---|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+	for _, cs := range r.Chunkers {
+		diff := "-"
+		if cs.Baseline != "" {
+			diff = fmt.Sprintf("%+d (%+.2f%%)", cs.GasDiffVsBaseline, cs.GasDiffVsBaselinePct)
+		}
+		fmt.Fprintf(&sb, "| %s | %d | %d | %d | %.2f%% | %s | %.2f%% | %.2f%% | %.2f%% |\n",
+			cs.Name, cs.Gas, cs.BranchGas, cs.WitnessBytes, cs.CodeGasPct, diff,
+			cs.TxOverheadPct.P50, cs.TxOverheadPct.P90, cs.TxOverheadPct.P99)
+	}
+
+	fmt.Fprintf(&sb, "\n## Code size\n\n")
+	fmt.Fprintf(&sb, "| Chunker | Chunked size | Overhead |\n")
+	fmt.Fprintf(&sb, "|---|---:|---:|\n")
+	for _, cs := range r.Chunkers {
+		fmt.Fprintf(&sb, "| %s | %d | %.2f%% |\n", cs.Name, cs.ChunkedCodeSize, cs.SizeOverheadPct)
+	}
+
+	fmt.Fprintf(&sb, "\n## Tx overhead histogram\n\n")
+	fmt.Fprintf(&sb, "| Chunker |")
+	for _, bound := range txOverheadBounds {
+		fmt.Fprintf(&sb, " <= %g%% |", bound)
+	}
+	fmt.Fprintf(&sb, " > %g%% |\n|---|", txOverheadBounds[len(txOverheadBounds)-1])
+	fmt.Fprintf(&sb, "%s\n", strings.Repeat("---:|", len(txOverheadBounds)+1))
+	for _, cs := range r.Chunkers {
+		fmt.Fprintf(&sb, "| %s |", cs.Name)
+		for _, bucket := range cs.TxOverheadPctHistogram {
+			fmt.Fprintf(&sb, " %d |", bucket.Count)
+		}
+		fmt.Fprintf(&sb, "\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/analysis/eof"
+	"github.com/jsign/verkle-chunking-analysis/analysis/z32bytechunker"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	issueUnreadableTrace      = "unreadable_trace"
+	issueMissingCode          = "missing_code"
+	issueCodelessContract     = "codeless_contract"
+	issuePCOutOfRange         = "pc_out_of_range"
+	issuePCInPushdata         = "pc_in_pushdata"
+	issuePCOutsideCodeSection = "pc_outside_code_section"
+)
+
+// traceIssue is an inconsistency between a trace and the code corpus, aggregated for every
+// contract in the trace.
+type traceIssue struct {
+	traceIndex   int
+	tx           string
+	contractAddr common.Address
+	issue        string
+	occurrences  int
+	// firstPC is the lowest offending PC, or -1 if the issue isn't about PCs.
+	firstPC int
+	detail  string
+}
+
+// runValidate checks every trace against the code corpus, and reports the traced PCs that
+// can't be executed, and the touched contracts without code.
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	pcTraceFolderFlag := flags.String("tracespath", "", "Full path of the folder containing the traces")
+	outFlag := flags.String("out", ".", "Folder where the generated files are written")
+	runIDFlag := flags.String("run-id", "", "Prefix for the names of the generated files, to keep the results of different runs apart")
+	formatFlag := flags.String("format", formatCSV, fmt.Sprintf("Format of the generated table (%s)", strings.Join(tableFormats, "|")))
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *pcTraceFolderFlag == "" {
+		return fmt.Errorf("expected --tracespath <folder> flag")
+	}
+	if !slices.Contains(tableFormats, *formatFlag) {
+		return fmt.Errorf("unsupported output format %s", *formatFlag)
+	}
+	out := outputFiles{dir: *outFlag, runID: *runIDFlag, format: *formatFlag}
+	if err := os.MkdirAll(out.dir, 0755); err != nil {
+		return fmt.Errorf("could not create output folder: %s", err)
+	}
+
+	pcTracePaths, contractBytecodes, err := loadData(*pcTraceFolderFlag, -1)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Validating traces... ")
+	validator := newTraceValidator(contractBytecodes)
+	var lock sync.Mutex
+	var issues []traceIssue
+	group, _ := errgroup.WithContext(context.Background())
+	group.SetLimit(runtime.NumCPU())
+	for i, pcTracePath := range pcTracePaths {
+		i, pcTracePath := i, pcTracePath
+		group.Go(func() error {
+			traceIssues := validator.validate(i, pcTracePath)
+			lock.Lock()
+			issues = append(issues, traceIssues...)
+			lock.Unlock()
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return fmt.Errorf("error validating traces: %s", err)
+	}
+	fmt.Printf("OK\n")
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].traceIndex != issues[j].traceIndex {
+			return issues[i].traceIndex < issues[j].traceIndex
+		}
+		if c := bytes.Compare(issues[i].contractAddr[:], issues[j].contractAddr[:]); c != 0 {
+			return c < 0
+		}
+		return issues[i].issue < issues[j].issue
+	})
+
+	if err := genTraceIssuesTable(issues, out); err != nil {
+		return fmt.Errorf("error exporting trace issues: %s", err)
+	}
+	issueCounts := map[string]int{}
+	tracesWithIssues := map[int]struct{}{}
+	for _, issue := range issues {
+		issueCounts[issue.issue]++
+		tracesWithIssues[issue.traceIndex] = struct{}{}
+	}
+	fmt.Printf("Validated %d traces, %d have issues\n", len(pcTracePaths), len(tracesWithIssues))
+	for _, issue := range []string{issueUnreadableTrace, issueMissingCode, issueCodelessContract, issuePCOutOfRange, issuePCInPushdata, issuePCOutsideCodeSection} {
+		if issueCounts[issue] > 0 {
+			fmt.Printf("  %s: %d\n", issue, issueCounts[issue])
+		}
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("found %d issues in %d traces", len(issues), len(tracesWithIssues))
+	}
+	return nil
+}
+
+// traceValidator checks traces against the code corpus, caching the JUMPDEST analysis of every
+// contract since most of them are touched by many traces.
+type traceValidator struct {
+	contractBytecodes map[common.Address][]byte
+	// codeAnalysis caches a *codeAnalysis for every contract.
+	codeAnalysis sync.Map
+}
+
+type codeAnalysis struct {
+	eofContainer *eof.Container
+	// pushdata has a bit set for every PUSHDATA byte of legacy code.
+	pushdata []uint64
+}
+
+func newTraceValidator(contractBytecodes map[common.Address][]byte) *traceValidator {
+	return &traceValidator{contractBytecodes: contractBytecodes}
+}
+
+func (v *traceValidator) validate(traceIndex int, pcTracePath string) []traceIssue {
+	_, txHash := path.Split(pcTracePath)
+	txOutput, err := pipeline.ReadTrace(pcTracePath)
+	if err != nil {
+		return []traceIssue{{traceIndex: traceIndex, tx: txHash, issue: issueUnreadableTrace, firstPC: -1, detail: err.Error()}}
+	}
+
+	var issues []traceIssue
+	for _, addr := range pipeline.SortedAddresses(txOutput.ContractsPCs) {
+		pcs := txOutput.ContractsPCs[addr]
+		code, ok := v.contractBytecodes[addr]
+		if !ok || len(code) == 0 {
+			issue := traceIssue{traceIndex: traceIndex, tx: txHash, contractAddr: addr, issue: issueMissingCode, occurrences: len(pcs), firstPC: -1}
+			if ok {
+				issue.issue = issueCodelessContract
+			}
+			issues = append(issues, issue)
+			continue
+		}
+
+		analysis := v.analyze(addr, code)
+		var execution *eof.Execution
+		if analysis.eofContainer != nil {
+			execution = eof.NewExecution(analysis.eofContainer, code)
+		}
+		byIssue := map[string]*traceIssue{}
+		for _, pc := range pcs {
+			var kind string
+			switch {
+			case execution != nil:
+				if _, ok := execution.Offset(pc); !ok {
+					kind = issuePCOutsideCodeSection
+				}
+			case pc >= uint64(len(code)):
+				kind = issuePCOutOfRange
+			case analysis.pushdata[pc/64]&(1<<(pc%64)) != 0:
+				kind = issuePCInPushdata
+			}
+			if kind == "" {
+				continue
+			}
+			issue, ok := byIssue[kind]
+			if !ok {
+				issue = &traceIssue{traceIndex: traceIndex, tx: txHash, contractAddr: addr, issue: kind, firstPC: int(pc)}
+				byIssue[kind] = issue
+			}
+			issue.occurrences++
+			issue.firstPC = min(issue.firstPC, int(pc))
+		}
+		for _, issue := range byIssue {
+			issue.detail = fmt.Sprintf("code size %d", len(code))
+			issues = append(issues, *issue)
+		}
+	}
+	return issues
+}
+
+func (v *traceValidator) analyze(addr common.Address, code []byte) *codeAnalysis {
+	if analysis, ok := v.codeAnalysis.Load(addr); ok {
+		return analysis.(*codeAnalysis)
+	}
+	analysis := &codeAnalysis{}
+	if container, err := eof.Parse(code); err == nil {
+		analysis.eofContainer = container
+	} else {
+		analysis.pushdata = make([]uint64, (len(code)+63)/64)
+		for i := 0; i < len(code); {
+			if code[i] < z32bytechunker.PUSH1 || code[i] > z32bytechunker.PUSH32 {
+				i++
+				continue
+			}
+			pushDataEnd := i + int(code[i]-z32bytechunker.PUSH1+1)
+			for i++; i <= pushDataEnd && i < len(code); i++ {
+				analysis.pushdata[i/64] |= 1 << (i % 64)
+			}
+		}
+	}
+	v.codeAnalysis.Store(addr, analysis)
+	return analysis
+}
+
+func genTraceIssuesTable(issues []traceIssue, out outputFiles) (err error) {
+	columns := []column{
+		{name: "tx", kind: columnHash},
+		{name: "contract_addr", kind: columnAddress},
+		{name: "issue", kind: columnString},
+		{name: "occurrences", kind: columnInt},
+		{name: "first_pc", kind: columnInt},
+		{name: "detail", kind: columnString},
+	}
+	issuesTable, err := out.createTable("trace_issues", columns)
+	if err != nil {
+		return err
+	}
+	defer closeTable(issuesTable, &err)
+	for _, issue := range issues {
+		row := []any{common.HexToHash(issue.tx), issue.contractAddr, issue.issue, issue.occurrences, issue.firstPC, issue.detail}
+		if err := issuesTable.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
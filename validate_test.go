@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/jsign/verkle-chunking-analysis/pipeline"
+)
+
+func TestValidateTrace(t *testing.T) {
+	contract := common.HexToAddress("0xc0de01")
+	codeless := common.HexToAddress("0xc0de02")
+	missing := common.HexToAddress("0xc0de03")
+	// PUSH2 0x5b5b, JUMPDEST, STOP
+	code := []byte{0x61, 0x5b, 0x5b, 0x5b, 0x00}
+
+	tracePath := filepath.Join(t.TempDir(), "0x01")
+	f, err := os.Create(tracePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := pipeline.Trace{
+		ContractsPCs: map[common.Address][]uint64{
+			contract: {0, 3, 2, 1, 4, 7, 5},
+			codeless: {0},
+			missing:  {0, 1},
+		},
+		To: contract,
+	}
+	if err := gob.NewEncoder(f).Encode(trace); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	validator := newTraceValidator(map[common.Address][]byte{contract: code, codeless: {}})
+	issues := validator.validate(0, tracePath)
+	expected := map[common.Address]map[string][2]int{
+		contract: {issuePCInPushdata: {2, 1}, issuePCOutOfRange: {2, 5}},
+		codeless: {issueCodelessContract: {1, -1}},
+		missing:  {issueMissingCode: {2, -1}},
+	}
+	got := map[common.Address]map[string][2]int{}
+	for _, issue := range issues {
+		if got[issue.contractAddr] == nil {
+			got[issue.contractAddr] = map[string][2]int{}
+		}
+		got[issue.contractAddr][issue.issue] = [2]int{issue.occurrences, issue.firstPC}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected issues %v, got %v", expected, got)
+	}
+}